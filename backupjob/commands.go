@@ -0,0 +1,366 @@
+package backupjob
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Job is a backup job on a cluster, which the commands below act on. setup
+// runs them from the command line and ui-test from its form, so both do the
+// same.
+type Job struct {
+	Config
+	// LoginMode is how a token is obtained when there is none yet.
+	LoginMode LoginMode
+	// Notify, if set, shows the user what a login is waiting for, such as
+	// the code to enter on another device. Without it the messages are
+	// printed to stdout. It may be called from another goroutine than
+	// the one running the login.
+	Notify func(msg string)
+
+	kube *kubeApplier
+}
+
+// Connect checks the job's name and connects to its cluster. An empty
+// namespace is filled in from the kubeconfig context.
+func (j *Job) Connect() error {
+	if err := j.Validate(); err != nil {
+		return err
+	}
+	kube, err := newKubeApplier(j.Context, j.Namespace)
+	if err != nil {
+		return fmt.Errorf("unable to connect to Kubernetes: %v", err)
+	}
+	j.kube, j.Namespace = kube, kube.namespace
+	return nil
+}
+
+// Login gives the job credentials to back up with: the service account
+// key if there is one, else an OAuth login whose token is kept locally and
+// in the token Secret. force replaces a saved token with a new login.
+func (j *Job) Login(ctx context.Context, force bool) error {
+	names := j.Names()
+	if j.HasServiceAccountKey() {
+		return j.createSecretFromFile(ctx, names.ServiceAccountSecret, "key.json", j.ServiceAccountKey())
+	}
+	config, err := oauthConfig()
+	if err != nil {
+		return err
+	}
+	if err := j.createSecretFromFile(ctx, names.CredentialsSecret, "credentials.json", CredentialsFile); err != nil {
+		return err
+	}
+	if force {
+		os.Remove(j.TokenFile())
+	}
+	if _, err := j.getClient(ctx, config); err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+	return j.createSecretFromFile(ctx, names.TokenSecret, "token.json", j.TokenFile())
+}
+
+// CredentialsFile is the OAuth client all jobs log in with.
+const CredentialsFile = "../config/credentials.json"
+
+func oauthConfig() (*oauth2.Config, error) {
+	b, err := os.ReadFile(CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+	}
+	config, err := google.ConfigFromJSON(b, drive.DriveScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+	}
+	return config, nil
+}
+
+// HasServiceAccountKey reports whether the job authenticates with a service
+// account key instead of a user login.
+func (j *Job) HasServiceAccountKey() bool {
+	_, err := os.Stat(j.ServiceAccountKey())
+	return err == nil
+}
+
+// revokeURL is Google's OAuth token revocation endpoint.
+const revokeURL = "https://oauth2.googleapis.com/revoke"
+
+// Logout revokes the job's OAuth token and removes it locally and from the
+// cluster, so backups stop until the next login.
+func (j *Job) Logout(ctx context.Context) error {
+	var errs []error
+	if tok, err := tokenFromFile(j.TokenFile()); err == nil {
+		if err := revokeToken(ctx, tok); err != nil {
+			errs = append(errs, fmt.Errorf("unable to revoke token: %v", err))
+		}
+	}
+	if err := os.Remove(j.TokenFile()); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	if err := j.kube.deleteSecret(ctx, j.Names().TokenSecret); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// revokeToken revokes tok's grant. Revoking the refresh token also
+// invalidates the access tokens issued with it.
+func revokeToken(ctx context.Context, tok *oauth2.Token) error {
+	t := tok.RefreshToken
+	if t == "" {
+		t = tok.AccessToken
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {t}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// An already revoked or expired token is reported as invalid_token,
+	// which is what logging out wants anyway.
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("revocation returned %s", res.Status)
+	}
+	return nil
+}
+
+// ApplySettings are what apply puts on the cluster.
+type ApplySettings struct {
+	Schedule Schedule
+	// Dir is the directory to back up, as the user gave it.
+	Dir string
+	// Config is the config file the settings came from, stored for the
+	// container; nil if there is none.
+	Config *ConfigFile
+}
+
+// Validate checks the settings before anything is applied or exported.
+func (s ApplySettings) Validate() error {
+	if err := s.Schedule.Validate(); err != nil {
+		return InField("schedule", err)
+	}
+	if err := checkSourcePath(s.Dir); err != nil {
+		return fmt.Errorf("directory to back up: %v", err)
+	}
+	return nil
+}
+
+// Apply reconciles the job's objects with s, writing the planned changes to
+// w. A dry run stops after the plan.
+func (j *Job) Apply(ctx context.Context, w io.Writer, s ApplySettings, dryRun bool) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	manifests, err := j.Manifests(s.Schedule, HostPath(s.Dir))
+	if err != nil {
+		return err
+	}
+	plan, err := j.kube.plan(ctx, manifests...)
+	if err != nil {
+		return err
+	}
+	printPlan(w, plan)
+	if dryRun {
+		return nil
+	}
+
+	if j.HasServiceAccountKey() {
+		if err := j.createSecretFromFile(ctx, j.Names().ServiceAccountSecret, "key.json", j.ServiceAccountKey()); err != nil {
+			return err
+		}
+	}
+	if s.Config != nil {
+		if err := j.saveConfigFile(ctx, s.Config); err != nil {
+			return err
+		}
+	}
+	return j.kube.execute(ctx, w, plan)
+}
+
+// Manifests renders the job's RBAC, storage and CronJob manifests, in the
+// order they are applied.
+func (j *Job) Manifests(schedule Schedule, hostPath string) ([]string, error) {
+	values := ManifestValues{Names: j.Names(), Schedule: schedule, HostPath: hostPath, Image: BackupImage}
+	var manifests []string
+	for _, file := range []string{"rbac.yml", "pvc.yml", "cron.yml"} {
+		m, err := renderManifest(file, values, j.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render %s: %v", file, err)
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+// saveConfigFile stores cfg in the job's ConfigMap, where the container
+// reads its sources, destinations, retention and encryption settings, and
+// uploads the encryption key if cfg turns encryption on.
+func (j *Job) saveConfigFile(ctx context.Context, cfg *ConfigFile) error {
+	if cfg.Encryption.Enabled {
+		key := j.EncryptionKey()
+		if _, err := os.Stat(key); err != nil {
+			return FieldErrorf("encryption.enabled", "no encryption key at %s", key)
+		}
+		if err := j.createSecretFromFile(ctx, j.Names().EncryptionSecret, "encryption.key", key); err != nil {
+			return err
+		}
+	}
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return j.kube.applyConfigMap(ctx, j.Names().BackupConfig, map[string]string{ConfigFileKey: string(b)})
+}
+
+// createSecretFromFile makes the Secret name hold file under key.
+func (j *Job) createSecretFromFile(ctx context.Context, name, key, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return j.kube.applySecret(ctx, name, map[string][]byte{key: b})
+}
+
+// PrintStatus writes the job's schedule, recent runs and login state to w.
+func (j *Job) PrintStatus(ctx context.Context, w io.Writer) error {
+	names := j.Names()
+	st, err := j.kube.status(ctx, names)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Job %s in namespace %s\n", j.Name, j.Namespace)
+	token := "missing; run login"
+	if st.TokenSecret {
+		token = "present"
+	}
+	fmt.Fprintf(w, "Token secret %s: %s\n", names.TokenSecret, token)
+	cj := st.CronJob
+	if cj == nil {
+		fmt.Fprintf(w, "CronJob %s: not applied\n", names.CronJob)
+		return nil
+	}
+
+	schedule := cj.Spec.Schedule
+	if cj.Spec.TimeZone != nil {
+		schedule += " (" + *cj.Spec.TimeZone + ")"
+	}
+	fmt.Fprintf(w, "CronJob %s: %s, concurrency %s\n", cj.Name, schedule, cj.Spec.ConcurrencyPolicy)
+	if cj.Spec.Suspend != nil && *cj.Spec.Suspend {
+		fmt.Fprintln(w, "  suspended")
+	}
+	if t := cj.Status.LastScheduleTime; t != nil {
+		fmt.Fprintf(w, "  last scheduled:  %s\n", t.Local().Format(time.RFC1123))
+	}
+	if t := cj.Status.LastSuccessfulTime; t != nil {
+		fmt.Fprintf(w, "  last successful: %s\n", t.Local().Format(time.RFC1123))
+	}
+	if len(st.Runs) == 0 {
+		fmt.Fprintln(w, "No runs yet")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tCOMMAND\tSTATUS\tSTARTED\tDURATION")
+	for _, run := range st.Runs {
+		command := run.Labels[commandLabel]
+		if command == "" {
+			command = "scheduled"
+		}
+		status, duration := "running", ""
+		for _, c := range run.Status.Conditions {
+			if c.Status == corev1.ConditionTrue && (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) {
+				status = strings.ToLower(string(c.Type))
+			}
+		}
+		if run.Status.StartTime != nil && run.Status.CompletionTime != nil {
+			duration = run.Status.CompletionTime.Sub(run.Status.StartTime.Time).Round(time.Second).String()
+		}
+		started := run.CreationTimestamp.Local().Format("2006-01-02 15:04")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", run.Name, command, status, started, duration)
+	}
+	return tw.Flush()
+}
+
+// Run runs a quickstart command such as {"snapshots", "list"} with args in
+// a pod like the backup's, or a backup if command is nil. If wait is set it
+// waits for the pod and copies its output to w.
+func (j *Job) Run(ctx context.Context, w io.Writer, command, args []string, wait bool) error {
+	names := j.Names()
+	name, containerArgs := "run", []string(nil)
+	if command != nil {
+		st, err := j.kube.status(ctx, names)
+		if err != nil {
+			return err
+		}
+		// A restore would race the backup over the same files.
+		if command[0] == "restore" && st.CronJob != nil && len(st.CronJob.Status.Active) > 0 {
+			return errors.New("a backup is running; try again when it has finished")
+		}
+		// The backup's own arguments are backend flags every command
+		// takes.
+		name = command[0]
+		containerArgs = append(append(append([]string{}, command...), backupArgs(st)...), args...)
+	}
+	run, err := j.kube.startRun(ctx, names.CronJob, name, containerArgs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Started %s\n", run.Name)
+	if !wait {
+		return nil
+	}
+	_, runErr := j.kube.waitForRun(ctx, run.Name)
+	if err := j.kube.runLogs(ctx, run.Name, w); err != nil && runErr == nil {
+		return err
+	}
+	return runErr
+}
+
+// backupArgs are the container arguments of the job's backups.
+func backupArgs(st *jobStatus) []string {
+	if st.CronJob == nil {
+		return nil
+	}
+	containers := st.CronJob.Spec.JobTemplate.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return nil
+	}
+	return containers[0].Args
+}
+
+// Stop removes the job's CronJob and storage. Its Secrets stay, so a later
+// apply needs no new login.
+func (j *Job) Stop(ctx context.Context) error {
+	return j.kube.deleteBackup(ctx, j.Names())
+}
+
+// IsFlagSet reports whether the flag called name was given on the command
+// line, as opposed to holding its default.
+func IsFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
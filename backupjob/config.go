@@ -0,0 +1,247 @@
+package backupjob
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigAPIVersion is the version of the backup config file format. setup,
+// ui-test and the container read the same file, so a version they do not
+// know is refused rather than half understood.
+const ConfigAPIVersion = "drive-backup/v1"
+
+// ConfigFileKey is the key the config file is stored under in the job's
+// ConfigMap, and so its name where the container mounts it.
+const ConfigFileKey = "backup.yaml"
+
+// ConfigFile describes a whole backup job in one YAML or JSON file.
+type ConfigFile struct {
+	APIVersion string `json:"apiVersion"`
+	// Name is the job name, as given with -job.
+	Name     string         `json:"name"`
+	Schedule ConfigSchedule `json:"schedule"`
+	Source   ConfigSource   `json:"source"`
+	// Destinations are backed up to in one run; if there are none the
+	// container's backend flags decide where the backup goes.
+	Destinations []ConfigDestination `json:"destinations,omitempty"`
+	Retention    ConfigRetention     `json:"retention,omitempty"`
+	Encryption   ConfigEncryption    `json:"encryption,omitempty"`
+}
+
+type ConfigSchedule struct {
+	Cron                    string `json:"cron"`
+	TimeZone                string `json:"timeZone,omitempty"`
+	ConcurrencyPolicy       string `json:"concurrencyPolicy,omitempty"`
+	StartingDeadlineSeconds int64  `json:"startingDeadlineSeconds,omitempty"`
+}
+
+// ConfigSource is what gets backed up. Include and exclude are glob
+// patterns on slash-separated paths relative to the source; a pattern
+// without a slash matches a name at any depth.
+type ConfigSource struct {
+	// Path is the directory to back up, relative to the host directory
+	// mounted on the cluster's node (see HostPath). The container sees it
+	// at its -source directory.
+	Path    string   `json:"path"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ConfigDestination has the fields of the container's destinations.json
+// entries.
+type ConfigDestination struct {
+	Name           string `json:"name"`
+	Backend        string `json:"backend"`
+	Folder         string `json:"folder,omitempty"`
+	CredentialsDir string `json:"credentialsDir,omitempty"`
+	Auth           string `json:"auth,omitempty"`
+	Subject        string `json:"subject,omitempty"`
+	TokenSecret    string `json:"tokenSecret,omitempty"`
+	SharedDrive    string `json:"sharedDrive,omitempty"`
+	LocalDir       string `json:"localDir,omitempty"`
+}
+
+type ConfigRetention struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+}
+
+// ConfigEncryption turns client-side encryption on. The key itself stays
+// in its Secret and is never part of the config.
+type ConfigEncryption struct {
+	Enabled      bool `json:"enabled,omitempty"`
+	EncryptNames bool `json:"encryptNames,omitempty"`
+}
+
+// fieldError is a config error at a field path such as
+// "destinations[1].backend".
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.Err
+}
+
+// FieldErrorf returns a config error at the field path field, such as
+// "[1].localDir" for the container's destinations.
+func FieldErrorf(field, format string, args ...interface{}) error {
+	return &fieldError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// InField puts err under the field path field, keeping any path it has.
+func InField(field string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		sep := "."
+		if strings.HasPrefix(fe.Field, "[") {
+			sep = ""
+		}
+		return &fieldError{Field: field + sep + fe.Field, Err: fe.Err}
+	}
+	return &fieldError{Field: field, Err: err}
+}
+
+// LoadConfigFile reads and checks a config file. YAML and JSON are both
+// accepted, and unknown fields are errors so typos do not go unnoticed.
+func LoadConfigFile(file string) (*ConfigFile, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfigFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return c, nil
+}
+
+func parseConfigFile(b []byte) (*ConfigFile, error) {
+	var version struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := yaml.Unmarshal(b, &version); err != nil {
+		return nil, err
+	}
+	switch version.APIVersion {
+	case ConfigAPIVersion:
+	case "":
+		return nil, FieldErrorf("apiVersion", "missing; want %s", ConfigAPIVersion)
+	default:
+		return nil, FieldErrorf("apiVersion", "unsupported version %q (want %s)", version.APIVersion, ConfigAPIVersion)
+	}
+
+	c := &ConfigFile{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var configNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// validate checks what can be checked without the cluster or the backends;
+// setup and the container check the schedule and destinations further.
+func (c *ConfigFile) validate() error {
+	if c.Name == "" {
+		return FieldErrorf("name", "missing")
+	}
+	if c.Schedule.Cron == "" {
+		return FieldErrorf("schedule.cron", "missing")
+	}
+	if c.Schedule.StartingDeadlineSeconds < 0 {
+		return FieldErrorf("schedule.startingDeadlineSeconds", "must not be negative")
+	}
+	if err := checkSourcePath(c.Source.Path); err != nil {
+		return InField("source.path", err)
+	}
+	for i, p := range c.Source.Include {
+		if err := checkPattern(p); err != nil {
+			return FieldErrorf(fmt.Sprintf("source.include[%d]", i), "%v", err)
+		}
+	}
+	for i, p := range c.Source.Exclude {
+		if err := checkPattern(p); err != nil {
+			return FieldErrorf(fmt.Sprintf("source.exclude[%d]", i), "%v", err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, d := range c.Destinations {
+		field := fmt.Sprintf("destinations[%d]", i)
+		if !configNameRE.MatchString(d.Name) {
+			return FieldErrorf(field+".name", "%q must be lower-case letters, digits and dashes", d.Name)
+		}
+		if seen[d.Name] {
+			return FieldErrorf(field+".name", "duplicate name %q", d.Name)
+		}
+		seen[d.Name] = true
+		switch d.Backend {
+		case "drive", "s3", "local":
+		default:
+			return FieldErrorf(field+".backend", "unknown backend %q (want drive, s3 or local)", d.Backend)
+		}
+	}
+
+	r := c.Retention
+	for _, k := range []struct {
+		field string
+		n     int
+	}{{"keepLast", r.KeepLast}, {"keepDaily", r.KeepDaily}, {"keepWeekly", r.KeepWeekly}, {"keepMonthly", r.KeepMonthly}} {
+		if k.n < 0 {
+			return FieldErrorf("retention."+k.field, "must not be negative")
+		}
+	}
+	if c.Encryption.EncryptNames && !c.Encryption.Enabled {
+		return FieldErrorf("encryption.encryptNames", "needs encryption.enabled")
+	}
+	return nil
+}
+
+// checkSourcePath reports a source path HostPath cannot map onto the
+// node's host mount.
+func checkSourcePath(p string) error {
+	if strings.TrimSpace(p) == "" {
+		return errors.New("missing")
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(p), "/") {
+		if elem == ".." {
+			return fmt.Errorf("%q must not leave the host mount with ..", p)
+		}
+	}
+	return nil
+}
+
+// checkPattern reports a malformed include or exclude pattern.
+func checkPattern(p string) error {
+	if p == "" {
+		return errors.New("empty pattern")
+	}
+	if strings.HasPrefix(p, "/") {
+		return fmt.Errorf("pattern %q must be relative to the source", p)
+	}
+	if _, err := path.Match(p, ""); err != nil {
+		return fmt.Errorf("pattern %q: %v", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package backupjob
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testConfigYAML = `apiVersion: drive-backup/v1
+name: photos
+schedule:
+  cron: "30 2 * * *"
+  timeZone: Europe/Berlin
+source:
+  path: /Users/me/Pictures
+  exclude: ["*.tmp", "cache/**"]
+destinations:
+- name: drive
+  backend: drive
+  folder: Backups
+retention:
+  keepDaily: 7
+encryption:
+  enabled: true
+`
+
+func TestLoadConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.yaml")
+	if err := os.WriteFile(file, []byte(testConfigYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, s, err := FromConfigFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != "photos" || s.Cron != "30 2 * * *" || s.TimeZone != "Europe/Berlin" || s.ConcurrencyPolicy != DefaultConcurrencyPolicy {
+		t.Errorf("job %+v, schedule %+v", job, s)
+	}
+	if len(c.Source.Exclude) != 2 || c.Destinations[0].Folder != "Backups" || c.Retention.KeepDaily != 7 || !c.Encryption.Enabled {
+		t.Errorf("config = %+v", c)
+	}
+
+	// The same file as JSON.
+	if _, err := parseConfigFile([]byte(`{"apiVersion":"drive-backup/v1","name":"photos","schedule":{"cron":"@daily"},"source":{"path":"photos"}}`)); err != nil {
+		t.Errorf("JSON config: %v", err)
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfigFile of a missing file succeeded")
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(string) string
+		want string // start of the error
+	}{
+		{"no version", func(s string) string { return strings.Replace(s, "apiVersion: drive-backup/v1\n", "", 1) }, "apiVersion: missing"},
+		{"new version", func(s string) string { return strings.Replace(s, "/v1", "/v2", 1) }, "apiVersion: unsupported version"},
+		{"unknown field", func(s string) string { return strings.Replace(s, "keepDaily", "keepDialy", 1) }, "error unmarshaling JSON"},
+		{"no name", func(s string) string { return strings.Replace(s, "name: photos\n", "", 1) }, "name: missing"},
+		{"no cron", func(s string) string { return strings.Replace(s, `cron: "30 2 * * *"`, `cron: ""`, 1) }, "schedule.cron: missing"},
+		{"no path", func(s string) string { return strings.Replace(s, "path: /Users/me/Pictures", "path: ''", 1) }, "source.path: missing"},
+		{"path leaves mount", func(s string) string { return strings.Replace(s, "/Users/me/Pictures", "../etc", 1) }, "source.path: \"../etc\" must not leave"},
+		{"absolute pattern", func(s string) string { return strings.Replace(s, `"cache/**"`, `"/cache"`, 1) }, "source.exclude[1]: pattern"},
+		{"bad pattern", func(s string) string { return strings.Replace(s, `"*.tmp"`, `"[a-"`, 1) }, "source.exclude[0]: pattern"},
+		{"destination name", func(s string) string { return strings.Replace(s, "- name: drive", "- name: My Drive", 1) }, "destinations[0].name:"},
+		{"backend", func(s string) string { return strings.Replace(s, "backend: drive", "backend: ftp", 1) }, "destinations[0].backend: unknown backend"},
+		{"negative retention", func(s string) string { return strings.Replace(s, "keepDaily: 7", "keepDaily: -1", 1) }, "retention.keepDaily:"},
+		{"names without encryption", func(s string) string { return strings.Replace(s, "enabled: true", "encryptNames: true", 1) }, "encryption.encryptNames:"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfigFile([]byte(tt.edit(testConfigYAML)))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q...", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFromConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*ConfigFile)
+		want string
+	}{
+		{"job name", func(c *ConfigFile) { c.Name = "Photos" }, "name:"},
+		{"cron", func(c *ConfigFile) { c.Schedule.Cron = "every day" }, "schedule.cron:"},
+		{"time zone", func(c *ConfigFile) { c.Schedule.TimeZone = "Berlin" }, "schedule.timeZone:"},
+		{"policy", func(c *ConfigFile) { c.Schedule.ConcurrencyPolicy = "Never" }, "schedule.concurrencyPolicy:"},
+	}
+	for _, tt := range tests {
+		c, err := parseConfigFile([]byte(testConfigYAML))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.edit(c)
+		if _, _, err := FromConfigFile(c); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q...", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	var root string
+	switch runtime.GOOS {
+	case "linux":
+		root = "/host"
+	case "windows":
+		root = "/run/desktop/mnt/host"
+	}
+	// Paths typed with or without a leading slash name the same folder.
+	for dir, want := range map[string]string{
+		"photos":             root + "/photos",
+		"/photos":            root + "/photos",
+		"//photos/2024":      root + "/photos/2024",
+		"/Users/me/Pictures": root + "/Users/me/Pictures",
+	} {
+		if got := HostPath(dir); got != want {
+			t.Errorf("HostPath(%q) = %q, want %q", dir, got, want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package backupjob
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// DefaultName is the job setup configured before jobs had names. It
+// keeps the original object names so existing installs carry on.
+const DefaultName = "drive-backup"
+
+// Config identifies one backup job, so several (different folders,
+// schedules or accounts) can share a cluster.
+type Config struct {
+	Name string
+	// Namespace is where the job's objects live; empty means the
+	// kubeconfig context's namespace.
+	Namespace string
+	// Context is the kubeconfig context to use; empty means the current
+	// one.
+	Context string
+}
+
+var jobNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,38}[a-z0-9])?$`)
+
+func (j Config) Validate() error {
+	if !jobNameRE.MatchString(j.Name) {
+		return fmt.Errorf("job name %q must be at most 40 lower-case letters, digits and dashes", j.Name)
+	}
+	return nil
+}
+
+// Names are the names of a job's Kubernetes objects. Their JSON names
+// are the keys under names in the manifest templates' values.
+type Names struct {
+	CronJob string `json:"cronJob"`
+	// PV is PVBase with the namespace in front; the manifests work it out
+	// from the namespace they are rendered or installed into. It is empty
+	// while the job has no namespace.
+	PV             string `json:"-"`
+	PVBase         string `json:"pvBase"`
+	PVC            string `json:"pvc"`
+	ServiceAccount string `json:"serviceAccount"`
+	Role           string `json:"role"`
+
+	CredentialsSecret    string `json:"credentialsSecret"`
+	TokenSecret          string `json:"tokenSecret"`
+	ServiceAccountSecret string `json:"serviceAccountSecret"`
+	EncryptionSecret     string `json:"encryptionSecret"`
+	S3Secret             string `json:"s3Secret"`
+	DestinationsConfig   string `json:"destinationsConfig"`
+	BackupConfig         string `json:"backupConfig"`
+}
+
+// Names returns the object names for the job. Other jobs prefix every name
+// with the job name; the PV is cluster-wide, so it also gets the namespace.
+func (j Config) Names() Names {
+	if j.Name == DefaultName {
+		pv, _ := pvName(j.Namespace, "backup-pv")
+		return Names{
+			CronJob:              "drive-backup-cronjob",
+			PV:                   pv,
+			PVBase:               "backup-pv",
+			PVC:                  "backup-pvc",
+			ServiceAccount:       "drive-backup",
+			Role:                 "drive-backup-token",
+			CredentialsSecret:    "google-credentials",
+			TokenSecret:          "token",
+			ServiceAccountSecret: "google-service-account",
+			EncryptionSecret:     "encryption-key",
+			S3Secret:             "s3-credentials",
+			DestinationsConfig:   "backup-destinations",
+			BackupConfig:         "backup-config",
+		}
+	}
+	n := j.Name
+	pv, _ := pvName(j.Namespace, n)
+	return Names{
+		CronJob:              n,
+		PV:                   pv,
+		PVBase:               n,
+		PVC:                  n,
+		ServiceAccount:       n,
+		Role:                 n + "-token",
+		CredentialsSecret:    n + "-google-credentials",
+		TokenSecret:          n + "-token",
+		ServiceAccountSecret: n + "-google-service-account",
+		EncryptionSecret:     n + "-encryption-key",
+		S3Secret:             n + "-s3-credentials",
+		DestinationsConfig:   n + "-destinations",
+		BackupConfig:         n + "-config",
+	}
+}
+
+// errNoNamespace is returned for names and manifests that depend on the
+// namespace before the job has one; Connect fills it in.
+var errNoNamespace = errors.New("the job has no namespace yet")
+
+// pvName is the drive-backup.pvName manifest template: base prefixed with
+// the namespace, except for the default job's PV in the default namespace.
+func pvName(namespace, base string) (string, error) {
+	if namespace == "" {
+		return "", errNoNamespace
+	}
+	if namespace == "default" && base == "backup-pv" {
+		return base, nil
+	}
+	return namespace + "-" + base, nil
+}
+
+// configFile is where the job keeps a local file such as its token: in
+// ../config for the default job and in ../config/<job> for others, so each
+// job can log in with its own account.
+func (j Config) configFile(name string) string {
+	if j.Name == DefaultName {
+		return filepath.Join("../config", name)
+	}
+	return filepath.Join("../config", j.Name, name)
+}
+
+func (j Config) TokenFile() string {
+	return j.configFile("token.json")
+}
+
+// ServiceAccountKey is an optional service account JSON key. When present
+// the CronJob authenticates with it and no browser login is needed.
+func (j Config) ServiceAccountKey() string {
+	return j.configFile("service-account.json")
+}
+
+// FromConfigFile returns the job and schedule a config file describes.
+// Namespace and context stay with the command line, so the same file can
+// be applied to several clusters.
+func FromConfigFile(c *ConfigFile) (Config, Schedule, error) {
+	j := Config{Name: c.Name}
+	if err := j.Validate(); err != nil {
+		return j, Schedule{}, InField("name", err)
+	}
+	s := Schedule{
+		Cron:                    c.Schedule.Cron,
+		TimeZone:                c.Schedule.TimeZone,
+		ConcurrencyPolicy:       c.Schedule.ConcurrencyPolicy,
+		StartingDeadlineSeconds: c.Schedule.StartingDeadlineSeconds,
+	}
+	if s.ConcurrencyPolicy == "" {
+		s.ConcurrencyPolicy = DefaultConcurrencyPolicy
+	}
+	return j, s, InField("schedule", s.Validate())
+}
+
+// EncryptionKey is the key file setup uploads when the config file turns
+// encryption on.
+func (j Config) EncryptionKey() string {
+	return j.configFile("encryption.key")
+}
+
+// BackupImage is the backup container image the CronJob runs.
+const BackupImage = "aayushsenapati/drive-backup:latest"
+
+// ManifestValues are what the manifest templates refer to as .Values, and
+// the values of the Helm chart setup exports from the same templates.
+type ManifestValues struct {
+	Names    Names    `json:"names"`
+	Schedule Schedule `json:"schedule"`
+	// HostPath is the directory on the node to back up.
+	HostPath string `json:"hostPath"`
+	Image    string `json:"image"`
+}
+
+// manifestFS holds the templates of the job's objects, built into the binary
+// so it runs from any directory. They are Helm templates as well, so they
+// only use what Go templates and Helm have in common: .Values, the
+// .Release.Namespace they go into, and toJson.
+//
+//go:embed manifests/*
+var manifestFS embed.FS
+
+// manifestHelpers holds the named templates the manifests share.
+const manifestHelpers = "_helpers.tpl"
+
+// ManifestTemplates returns the manifest templates, for a Helm chart's
+// templates directory.
+func ManifestTemplates() fs.FS {
+	sub, _ := fs.Sub(manifestFS, "manifests")
+	return sub
+}
+
+// manifestFuncs are the functions the manifest templates can call, named
+// as in Helm.
+var manifestFuncs = template.FuncMap{"toJson": toJSON}
+
+// toJSON writes v as JSON, which is valid YAML: strings come out
+// double-quoted, so values such as paths cannot break out of the field they
+// are put in, and numbers in full, where the template's default formatting
+// would write a float64 of a million as 1e+06.
+func toJSON(v interface{}) (string, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// renderManifest fills in the manifest template name for namespace.
+func renderManifest(name string, values ManifestValues, namespace string) (string, error) {
+	// Without a namespace the templates would name the PV "-<pvBase>".
+	if namespace == "" {
+		return "", errNoNamespace
+	}
+	t, err := template.New(name).Option("missingkey=error").Funcs(manifestFuncs).
+		ParseFS(manifestFS, "manifests/"+name, "manifests/"+manifestHelpers)
+	if err != nil {
+		return "", err
+	}
+	// The templates see the values as Helm does, as maps keyed by the
+	// fields' JSON names.
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	data := map[string]interface{}{
+		"Values":  v,
+		"Release": map[string]interface{}{"Namespace": namespace},
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// HostPath is where dir, as setup and ui-test ask for it, is on the
+// cluster's node. dir is relative to the host directory minikube or Docker
+// Desktop mounts on the node; a leading slash is ignored, so "/photos" and
+// "photos" are the same folder in both tools.
+func HostPath(dir string) string {
+	dir = strings.TrimLeft(filepath.ToSlash(dir), "/")
+	switch runtime.GOOS {
+	case "linux":
+		return "/host/" + dir
+	case "windows":
+		return "/run/desktop/mnt/host/" + dir
+	}
+	return "/" + dir
+}
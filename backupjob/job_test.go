@@ -0,0 +1,205 @@
+package backupjob
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"photos", `"photos"`},
+		{"", `""`},
+		{"/host/My Photos", `"/host/My Photos"`},
+		{`say "cheese"`, `"say \"cheese\""`},
+		{`C:\Users\me`, `"C:\\Users\\me"`},
+		{"a\nb: c", `"a\nb: c"`},
+		{"key: value", `"key: value"`},
+		{"# not a comment", `"# not a comment"`},
+		{"{{ .Release.Name }}", `"{{ .Release.Name }}"`},
+		{"50% & <more>", `"50% & <more>"`},
+		{"Fotos/Ürlaub 🏖", `"Fotos/Ürlaub 🏖"`},
+		{"yes", `"yes"`},
+		{"\t*/5 * * * *", `"\t*/5 * * * *"`},
+	}
+	for _, tt := range tests {
+		got, err := toJSON(tt.in)
+		if err != nil {
+			t.Errorf("toJSON(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("toJSON(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+		// Whatever the value, it reads back as the same single string.
+		var v struct {
+			Field interface{} `json:"field"`
+		}
+		if err := yaml.UnmarshalStrict([]byte("field: "+got+"\n"), &v); err != nil {
+			t.Errorf("toJSON(%q) is not a YAML value: %v", tt.in, err)
+		} else if v.Field != tt.in {
+			t.Errorf("toJSON(%q) reads back as %#v", tt.in, v.Field)
+		}
+	}
+}
+
+// testValues are the values the golden files are rendered with, in the
+// namespace backups.
+func testValues() ManifestValues {
+	return ManifestValues{
+		Names:    Config{Name: "photos", Namespace: "backups"}.Names(),
+		Schedule: Schedule{Cron: "30 2 * * 1-5", TimeZone: "Europe/Berlin", ConcurrencyPolicy: "Forbid", StartingDeadlineSeconds: 600},
+		HostPath: "/host/My Photos/2024: \"summer\"",
+		Image:    BackupImage,
+	}
+}
+
+// TestRenderManifests compares the rendered manifests with the files in
+// testdata; run with -update to rewrite them after changing a template.
+func TestRenderManifests(t *testing.T) {
+	entries, err := manifestFS.ReadDir("manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == manifestHelpers {
+			continue
+		}
+		checkGolden(t, e.Name(), testValues(), strings.TrimSuffix(e.Name(), ".yml")+".golden")
+	}
+
+	// The values reach the templates as float64, which they would print
+	// as 1e+06 from a million on.
+	values := testValues()
+	values.Schedule.StartingDeadlineSeconds = 2592000
+	checkGolden(t, "cron.yml", values, "cron-long-deadline.golden")
+}
+
+// checkGolden renders the manifest template name with values and compares
+// the result with testdata/golden.
+func checkGolden(t *testing.T, name string, values ManifestValues, golden string) {
+	t.Helper()
+	got, err := renderManifest(name, values, "backups")
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	golden = filepath.Join("testdata", golden)
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from %s:\n%s", name, golden, got)
+	}
+}
+
+// TestRenderManifestsInjection checks values cannot add fields or objects
+// to the manifests they are rendered into.
+func TestRenderManifestsInjection(t *testing.T) {
+	k := &kubeApplier{client: fake.NewClientset(), namespace: "backups"}
+	tests := []struct {
+		name string
+		edit func(*ManifestValues)
+	}{
+		{"new field", func(v *ManifestValues) { v.HostPath = "/host/x\n    type: Socket" }},
+		{"new object", func(v *ManifestValues) { v.HostPath = "/host/x\n---\nkind: Pod" }},
+		{"flow mapping", func(v *ManifestValues) { v.Schedule.Cron = "0 * * * *\", suspend: true, x: \"" }},
+		{"template action", func(v *ManifestValues) { v.Schedule.TimeZone = "{{.Names.CronJob}}" }},
+		{"format verb", func(v *ManifestValues) { v.HostPath = "/host/100%s%d" }},
+	}
+	for _, tt := range tests {
+		values := testValues()
+		tt.edit(&values)
+		var objects int
+		for _, name := range []string{"cron.yml", "pvc.yml"} {
+			manifest, err := renderManifest(name, values, "backups")
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			objs, err := k.decodeManifests(manifest)
+			if err != nil {
+				t.Errorf("%s: %s does not decode: %v", tt.name, name, err)
+				continue
+			}
+			objects += len(objs)
+			for _, o := range objs {
+				if o.Kind == "PersistentVolume" && !strings.Contains(manifest, "path: "+mustToJSON(t, values.HostPath)) {
+					t.Errorf("%s: host path not rendered as one value:\n%s", tt.name, manifest)
+				}
+				if o.Kind == "CronJob" && strings.Contains(manifest, "\n  suspend:") {
+					t.Errorf("%s: CronJob gained a field:\n%s", tt.name, manifest)
+				}
+			}
+		}
+		if objects != 3 {
+			t.Errorf("%s: rendered %d objects, want 3", tt.name, objects)
+		}
+	}
+}
+
+func mustToJSON(t *testing.T, s string) string {
+	t.Helper()
+	q, err := toJSON(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// TestPVName checks the manifests name the PV as Names does, so Stop
+// deletes the PV Apply or the Helm chart created.
+func TestPVName(t *testing.T) {
+	tests := []struct {
+		job, namespace, want string
+	}{
+		{DefaultName, "default", "backup-pv"},
+		{DefaultName, "backups", "backups-backup-pv"},
+		{"photos", "default", "default-photos"},
+		{"photos", "backups", "backups-photos"},
+	}
+	for _, tt := range tests {
+		names := Config{Name: tt.job, Namespace: tt.namespace}.Names()
+		if names.PV != tt.want {
+			t.Errorf("%s in %s: Names().PV = %q, want %q", tt.job, tt.namespace, names.PV, tt.want)
+		}
+		values := testValues()
+		values.Names = names
+		manifest, err := renderManifest("pvc.yml", values, tt.namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"  name: \"" + tt.want + "\"\n", "  volumeName: \"" + tt.want + "\"\n"} {
+			if !strings.Contains(manifest, want) {
+				t.Errorf("%s in %s: manifest lacks %q:\n%s", tt.job, tt.namespace, want, manifest)
+			}
+		}
+	}
+
+	// Before Connect has filled in the namespace there is no PV name to
+	// give, rather than one starting with a dash.
+	for _, name := range []string{DefaultName, "photos"} {
+		if pv := (Config{Name: name}).Names().PV; pv != "" {
+			t.Errorf("%s without a namespace: Names().PV = %q, want none", name, pv)
+		}
+	}
+	if _, err := renderManifest("pvc.yml", testValues(), ""); !errors.Is(err, errNoNamespace) {
+		t.Errorf("rendering without a namespace: error = %v, want %v", err, errNoNamespace)
+	}
+}
@@ -0,0 +1,454 @@
+package backupjob
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	batchv1ac "k8s.io/client-go/applyconfigurations/batch/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
+	rbacv1ac "k8s.io/client-go/applyconfigurations/rbac/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+// fieldManager owns the fields set through server-side apply; setup and
+// ui-test share it, so either can change what the other applied.
+const fieldManager = "drive-backup-setup"
+
+// kubeApplier creates and updates the backup's Kubernetes objects with
+// server-side apply. It takes a kubernetes.Interface so the fake clientset
+// can stand in for a cluster.
+type kubeApplier struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// newKubeApplier connects to the cluster of kubeconfig context kubeContext,
+// or of the current context like kubectl if it is empty. Objects go into
+// namespace, or the context's namespace if that is empty.
+func newKubeApplier(kubeContext, namespace string) (*kubeApplier, error) {
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext, Context: clientcmdapi.Context{Namespace: namespace}})
+	ns, _, err := cc.Namespace()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
+	}
+	cfg, err := cc.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Kubernetes client: %v", err)
+	}
+	return &kubeApplier{client: client, namespace: ns}, nil
+}
+
+func (k *kubeApplier) applyOptions() metav1.ApplyOptions {
+	return metav1.ApplyOptions{FieldManager: fieldManager, Force: true}
+}
+
+// manifestObject is one object from a manifest, with typed client calls to
+// read, apply and delete it.
+type manifestObject struct {
+	Kind string
+	Name string
+	// desired is the object as JSON-decoded data, for diffing against
+	// the live object.
+	desired map[string]interface{}
+	// immutable lists the field paths the API server will not change in
+	// place; changing one means recreating the object.
+	immutable []string
+	// optional lists field paths the manifest may leave out, which must
+	// then be cleared on the live object too.
+	optional []string
+
+	get    func(ctx context.Context) (interface{}, error)
+	apply  func(ctx context.Context, opts metav1.ApplyOptions) error
+	delete func(ctx context.Context) error
+}
+
+// decodeManifests parses every object in a multi-document YAML string.
+func (k *kubeApplier) decodeManifests(manifests string) ([]*manifestObject, error) {
+	var objs []*manifestObject
+	r := utilyaml.NewYAMLReader(bufio.NewReader(strings.NewReader(manifests)))
+	for {
+		doc, err := r.Read()
+		if err == io.EOF {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		js, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		if string(js) == "null" {
+			continue
+		}
+		obj, err := k.decodeObject(js)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+}
+
+// decodeObject decodes one object given as JSON, dispatching on its kind.
+func (k *kubeApplier) decodeObject(js []byte) (*manifestObject, error) {
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(js, &meta); err != nil {
+		return nil, err
+	}
+	m := &manifestObject{Kind: meta.Kind}
+	var ac interface{}
+	var err error
+	switch meta.Kind {
+	case "PersistentVolume":
+		obj := &corev1ac.PersistentVolumeApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*corev1.PersistentVolume](m, k.client.CoreV1().PersistentVolumes(), obj)
+			m.immutable = []string{"spec.hostPath", "spec.local", "spec.nfs", "spec.csi", "spec.storageClassName"}
+		}
+	case "PersistentVolumeClaim":
+		obj := &corev1ac.PersistentVolumeClaimApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			obj.WithNamespace(k.namespace)
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*corev1.PersistentVolumeClaim](m, k.client.CoreV1().PersistentVolumeClaims(k.namespace), obj)
+			m.immutable = []string{"spec.accessModes", "spec.volumeName", "spec.storageClassName", "spec.selector", "spec.volumeMode"}
+		}
+	case "ServiceAccount":
+		obj := &corev1ac.ServiceAccountApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			obj.WithNamespace(k.namespace)
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*corev1.ServiceAccount](m, k.client.CoreV1().ServiceAccounts(k.namespace), obj)
+		}
+	case "Role":
+		obj := &rbacv1ac.RoleApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			obj.WithNamespace(k.namespace)
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*rbacv1.Role](m, k.client.RbacV1().Roles(k.namespace), obj)
+		}
+	case "RoleBinding":
+		obj := &rbacv1ac.RoleBindingApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			obj.WithNamespace(k.namespace)
+			// Service account subjects must name their namespace, which
+			// the manifest cannot know.
+			for i := range obj.Subjects {
+				s := &obj.Subjects[i]
+				if s.Kind != nil && *s.Kind == "ServiceAccount" && s.Namespace == nil {
+					s.WithNamespace(k.namespace)
+				}
+			}
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*rbacv1.RoleBinding](m, k.client.RbacV1().RoleBindings(k.namespace), obj)
+			m.immutable = []string{"roleRef"}
+		}
+	case "CronJob":
+		obj := &batchv1ac.CronJobApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			obj.WithNamespace(k.namespace)
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*batchv1.CronJob](m, k.client.BatchV1().CronJobs(k.namespace), obj)
+			m.optional = []string{"spec.timeZone", "spec.startingDeadlineSeconds"}
+		}
+	case "Deployment":
+		obj := &appsv1ac.DeploymentApplyConfiguration{}
+		if err = json.Unmarshal(js, obj); err == nil {
+			obj.WithNamespace(k.namespace)
+			ac, m.Name = obj, nameOf(obj.ObjectMetaApplyConfiguration)
+			bind[*appsv1.Deployment](m, k.client.AppsV1().Deployments(k.namespace), obj)
+			m.immutable = []string{"spec.selector"}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported kind %q in manifest", meta.Kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %v", meta.Kind, err)
+	}
+	if m.Name == "" {
+		return nil, fmt.Errorf("%s in manifest has no name", meta.Kind)
+	}
+	if m.desired, err = toJSONMap(ac); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// typedClient is the part of a typed client a manifestObject calls.
+type typedClient[T, AC any] interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (T, error)
+	Apply(ctx context.Context, obj AC, opts metav1.ApplyOptions) (T, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// bind points m's calls at client, applying obj.
+func bind[T, AC any](m *manifestObject, client typedClient[T, AC], obj AC) {
+	m.get = func(ctx context.Context) (interface{}, error) {
+		return client.Get(ctx, m.Name, metav1.GetOptions{})
+	}
+	m.apply = func(ctx context.Context, opts metav1.ApplyOptions) error {
+		_, err := client.Apply(ctx, obj, opts)
+		return err
+	}
+	m.delete = func(ctx context.Context) error {
+		return client.Delete(ctx, m.Name, metav1.DeleteOptions{})
+	}
+}
+
+// toJSONMap converts an object to the generic form JSON decodes into.
+func toJSONMap(obj interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+func nameOf(meta *metav1ac.ObjectMetaApplyConfiguration) string {
+	if meta == nil || meta.Name == nil {
+		return ""
+	}
+	return *meta.Name
+}
+
+// applySecret makes Secret name hold exactly data.
+func (k *kubeApplier) applySecret(ctx context.Context, name string, data map[string][]byte) error {
+	obj := corev1ac.Secret(name, k.namespace).WithType("Opaque").WithData(data)
+	if _, err := k.client.CoreV1().Secrets(k.namespace).Apply(ctx, obj, k.applyOptions()); err != nil {
+		return fmt.Errorf("error applying secret %s: %v", name, err)
+	}
+	return nil
+}
+
+// applyConfigMap makes ConfigMap name hold exactly data.
+func (k *kubeApplier) applyConfigMap(ctx context.Context, name string, data map[string]string) error {
+	obj := corev1ac.ConfigMap(name, k.namespace).WithData(data)
+	if _, err := k.client.CoreV1().ConfigMaps(k.namespace).Apply(ctx, obj, k.applyOptions()); err != nil {
+		return fmt.Errorf("error applying config map %s: %v", name, err)
+	}
+	return nil
+}
+
+// deleteSecret removes Secret name; one that is already gone is not an
+// error.
+func (k *kubeApplier) deleteSecret(ctx context.Context, name string) error {
+	err := k.client.CoreV1().Secrets(k.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret %s: %v", name, err)
+	}
+	return nil
+}
+
+// deleteBackup removes a job's CronJob, PVC and PV. Objects that are
+// already gone are not an error.
+func (k *kubeApplier) deleteBackup(ctx context.Context, names Names) error {
+	var errs []error
+	del := func(kind, name string, err error) {
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("error deleting %s %s: %v", kind, name, err))
+		}
+	}
+	bg := metav1.DeletePropagationBackground
+	opts := metav1.DeleteOptions{PropagationPolicy: &bg}
+	del("CronJob", names.CronJob, k.client.BatchV1().CronJobs(k.namespace).Delete(ctx, names.CronJob, opts))
+	del("PersistentVolumeClaim", names.PVC, k.client.CoreV1().PersistentVolumeClaims(k.namespace).Delete(ctx, names.PVC, opts))
+	if names.PV == "" {
+		errs = append(errs, fmt.Errorf("error deleting PersistentVolume: %w", errNoNamespace))
+	} else {
+		del("PersistentVolume", names.PV, k.client.CoreV1().PersistentVolumes().Delete(ctx, names.PV, opts))
+	}
+	return errors.Join(errs...)
+}
+
+// commandLabel marks the Jobs started by a command rather than by the
+// schedule, with the command's name.
+const commandLabel = "drive-backup/command"
+
+// runTTL is how long Jobs started by a command are kept after finishing,
+// since the CronJob's history limits only cover scheduled ones.
+const runTTL = 24 * 60 * 60
+
+// startRun creates a Job from CronJob cronJob's template, like kubectl
+// create job --from. If args is not nil it replaces the container's
+// arguments, which runs another quickstart command in the backup's pod.
+func (k *kubeApplier) startRun(ctx context.Context, cronJob, command string, args []string) (*batchv1.Job, error) {
+	cj, err := k.client.BatchV1().CronJobs(k.namespace).Get(ctx, cronJob, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("CronJob %s not found; apply the job first", cronJob)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading CronJob %s: %v", cronJob, err)
+	}
+
+	spec := cj.Spec.JobTemplate.Spec.DeepCopy()
+	if args != nil {
+		if len(spec.Template.Spec.Containers) != 1 {
+			return nil, fmt.Errorf("CronJob %s has %d containers, want 1", cronJob, len(spec.Template.Spec.Containers))
+		}
+		spec.Template.Spec.Containers[0].Args = args
+		// Commands other than a backup are not retried.
+		spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+		backoff := int32(0)
+		spec.BackoffLimit = &backoff
+	}
+	ttl := int32(runTTL)
+	spec.TTLSecondsAfterFinished = &ttl
+
+	controller := true
+	j := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%s-%s", cronJob, command, strconv.FormatInt(time.Now().Unix(), 36)),
+			Namespace:   k.namespace,
+			Labels:      map[string]string{commandLabel: command},
+			Annotations: map[string]string{"cronjob.kubernetes.io/instantiate": "manual"},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       "CronJob",
+				Name:       cj.Name,
+				UID:        cj.UID,
+				Controller: &controller,
+			}},
+		},
+		Spec: *spec,
+	}
+	for key, value := range cj.Spec.JobTemplate.Labels {
+		j.Labels[key] = value
+	}
+	j, err = k.client.BatchV1().Jobs(k.namespace).Create(ctx, j, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, fmt.Errorf("error creating Job: %v", err)
+	}
+	return j, nil
+}
+
+// runPollInterval is how often waitForRun checks on a Job.
+var runPollInterval = 2 * time.Second
+
+// waitForRun waits for Job name to finish and returns it, or an error if it
+// failed.
+func (k *kubeApplier) waitForRun(ctx context.Context, name string) (*batchv1.Job, error) {
+	for {
+		j, err := k.client.BatchV1().Jobs(k.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error reading Job %s: %v", name, err)
+		}
+		for _, c := range j.Status.Conditions {
+			if c.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch c.Type {
+			case batchv1.JobComplete:
+				return j, nil
+			case batchv1.JobFailed:
+				return j, fmt.Errorf("Job %s failed: %s", name, c.Message)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return j, ctx.Err()
+		case <-time.After(runPollInterval):
+		}
+	}
+}
+
+// runLogs writes the logs of Job name's pods to w, oldest pod first.
+func (k *kubeApplier) runLogs(ctx context.Context, name string, w io.Writer) error {
+	pods, err := k.client.CoreV1().Pods(k.namespace).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + name})
+	if err != nil {
+		return fmt.Errorf("error listing pods of Job %s: %v", name, err)
+	}
+	items := pods.Items
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreationTimestamp.Before(&items[j].CreationTimestamp)
+	})
+	for _, pod := range items {
+		if len(items) > 1 {
+			fmt.Fprintf(w, "==> %s <==\n", pod.Name)
+		}
+		logs, err := k.client.CoreV1().Pods(k.namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).Stream(ctx)
+		if err != nil {
+			return fmt.Errorf("error reading logs of %s: %v", pod.Name, err)
+		}
+		_, err = io.Copy(w, logs)
+		logs.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobStatus is what the status command reports about a job.
+type jobStatus struct {
+	CronJob *batchv1.CronJob
+	// Runs are the Jobs the CronJob owns, newest first.
+	Runs []batchv1.Job
+	// TokenSecret reports whether the token Secret exists.
+	TokenSecret bool
+}
+
+// status reads the job's CronJob, runs and token Secret. A job that has not
+// been applied has a nil CronJob.
+func (k *kubeApplier) status(ctx context.Context, names Names) (*jobStatus, error) {
+	st := &jobStatus{}
+	cj, err := k.client.BatchV1().CronJobs(k.namespace).Get(ctx, names.CronJob, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		st.CronJob = cj
+	case !apierrors.IsNotFound(err):
+		return nil, fmt.Errorf("error reading CronJob %s: %v", names.CronJob, err)
+	}
+
+	if st.CronJob != nil {
+		jobs, err := k.client.BatchV1().Jobs(k.namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error listing Jobs: %v", err)
+		}
+		for _, j := range jobs.Items {
+			if owner := metav1.GetControllerOf(&j); owner != nil && owner.UID == cj.UID {
+				st.Runs = append(st.Runs, j)
+			}
+		}
+		sort.Slice(st.Runs, func(i, j int) bool {
+			return st.Runs[j].CreationTimestamp.Before(&st.Runs[i].CreationTimestamp)
+		})
+	}
+
+	_, err = k.client.CoreV1().Secrets(k.namespace).Get(ctx, names.TokenSecret, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		st.TokenSecret = true
+	case !apierrors.IsNotFound(err):
+		return nil, fmt.Errorf("error reading secret %s: %v", names.TokenSecret, err)
+	}
+	return st, nil
+}
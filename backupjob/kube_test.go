@@ -0,0 +1,241 @@
+package backupjob
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestJob returns the job "photos" in namespace "backups" of a fake
+// cluster holding objects.
+func newTestJob(t *testing.T, objects ...runtime.Object) (*Job, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewClientset(objects...)
+	j := &Job{
+		Config: Config{Name: "photos", Namespace: "backups"},
+		kube:   &kubeApplier{client: client, namespace: "backups"},
+	}
+	return j, client
+}
+
+func testSettings(cron string) ApplySettings {
+	return ApplySettings{Schedule: Schedule{Cron: cron, ConcurrencyPolicy: DefaultConcurrencyPolicy}, Dir: "photos"}
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	j, client := newTestJob(t)
+	var out strings.Builder
+	if err := j.Apply(ctx, &out, testSettings("@daily"), false); err != nil {
+		t.Fatalf("Apply: %v\n%s", err, out.String())
+	}
+
+	cj, err := client.BatchV1().CronJobs("backups").Get(ctx, "photos", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cj.Spec.Schedule != "@daily" || cj.Spec.ConcurrencyPolicy != batchv1.ForbidConcurrent {
+		t.Errorf("CronJob spec = %q, %q", cj.Spec.Schedule, cj.Spec.ConcurrencyPolicy)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(ctx, "backups-photos", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Spec.HostPath == nil || pv.Spec.HostPath.Path != HostPath("photos") {
+		t.Errorf("PV host path = %+v, want %s", pv.Spec.HostPath, HostPath("photos"))
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims("backups").Get(ctx, "photos", metav1.GetOptions{}); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.CoreV1().ServiceAccounts("backups").Get(ctx, "photos", metav1.GetOptions{}); err != nil {
+		t.Error(err)
+	}
+	role, err := client.RbacV1().Roles("backups").Get(ctx, "photos-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := role.Rules[0].ResourceNames; len(names) != 1 || names[0] != "photos-token" {
+		t.Errorf("Role covers secrets %v, want photos-token", names)
+	}
+	rb, err := client.RbacV1().RoleBindings("backups").Get(ctx, "photos-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := rb.Subjects[0]; s.Name != "photos" || s.Namespace != "backups" {
+		t.Errorf("RoleBinding subject = %+v", s)
+	}
+
+	// A dry run only prints the change.
+	out.Reset()
+	if err := j.Apply(ctx, &out, testSettings("@hourly"), true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "~   CronJob photos (update): spec.schedule") {
+		t.Errorf("dry run plan:\n%s", out.String())
+	}
+	if cj, _ := client.BatchV1().CronJobs("backups").Get(ctx, "photos", metav1.GetOptions{}); cj.Spec.Schedule != "@daily" {
+		t.Errorf("dry run changed the schedule to %q", cj.Spec.Schedule)
+	}
+
+	out.Reset()
+	if err := j.Apply(ctx, &out, testSettings("@hourly"), false); err != nil {
+		t.Fatal(err)
+	}
+	if cj, _ := client.BatchV1().CronJobs("backups").Get(ctx, "photos", metav1.GetOptions{}); cj.Spec.Schedule != "@hourly" {
+		t.Errorf("schedule = %q after apply, want @hourly", cj.Spec.Schedule)
+	}
+}
+
+func TestApplyRefusesInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		s    ApplySettings
+	}{
+		{"bad cron", testSettings("every day")},
+		{"no directory", ApplySettings{Schedule: testSettings("@daily").Schedule, Dir: " "}},
+		{"bad policy", ApplySettings{Schedule: Schedule{Cron: "@daily", ConcurrencyPolicy: "Sometimes"}, Dir: "photos"}},
+	}
+	for _, tt := range tests {
+		j, client := newTestJob(t)
+		var out strings.Builder
+		if err := j.Apply(context.Background(), &out, tt.s, false); err == nil {
+			t.Errorf("%s: Apply succeeded", tt.name)
+		}
+		if len(client.Actions()) != 0 {
+			t.Errorf("%s: Apply made %d calls to the cluster", tt.name, len(client.Actions()))
+		}
+	}
+}
+
+func TestDecodeManifests(t *testing.T) {
+	k := &kubeApplier{client: fake.NewClientset(), namespace: "backups"}
+	tests := []struct {
+		name     string
+		manifest string
+		kinds    []string
+		wantErr  bool
+	}{
+		{
+			name:     "several documents",
+			manifest: "kind: ServiceAccount\napiVersion: v1\nmetadata:\n  name: a\n---\n# comment only\n---\nkind: Role\napiVersion: rbac.authorization.k8s.io/v1\nmetadata:\n  name: b\n",
+			kinds:    []string{"ServiceAccount", "Role"},
+		},
+		{name: "empty", manifest: ""},
+		{name: "unsupported kind", manifest: "kind: Pod\napiVersion: v1\nmetadata:\n  name: a\n", wantErr: true},
+		{name: "no name", manifest: "kind: ServiceAccount\napiVersion: v1\n", wantErr: true},
+		{name: "bad field", manifest: "kind: CronJob\napiVersion: batch/v1\nmetadata:\n  name: a\nspec: 3\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		objs, err := k.decodeManifests(tt.manifest)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: decodeManifests error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var kinds []string
+		for _, o := range objs {
+			kinds = append(kinds, o.Kind)
+		}
+		if strings.Join(kinds, ",") != strings.Join(tt.kinds, ",") {
+			t.Errorf("%s: kinds = %v, want %v", tt.name, kinds, tt.kinds)
+		}
+	}
+}
+
+func TestSecretsAndConfigMaps(t *testing.T) {
+	ctx := context.Background()
+	j, client := newTestJob(t)
+	k := j.kube
+	if err := k.applySecret(ctx, "s", map[string][]byte{"a": []byte("1"), "b": []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	// A second apply replaces the data rather than merging it.
+	if err := k.applySecret(ctx, "s", map[string][]byte{"a": []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := client.CoreV1().Secrets("backups").Get(ctx, "s", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Data) != 1 || string(s.Data["a"]) != "3" {
+		t.Errorf("secret data = %q", s.Data)
+	}
+	if err := k.applyConfigMap(ctx, "c", map[string]string{ConfigFileKey: "name: x"}); err != nil {
+		t.Fatal(err)
+	}
+	if cm, err := client.CoreV1().ConfigMaps("backups").Get(ctx, "c", metav1.GetOptions{}); err != nil || cm.Data[ConfigFileKey] != "name: x" {
+		t.Errorf("config map = %v, %v", cm, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := k.deleteSecret(ctx, "s"); err != nil {
+			t.Errorf("deleteSecret, try %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestRunStatusAndStop(t *testing.T) {
+	ctx := context.Background()
+	j, client := newTestJob(t)
+	var out strings.Builder
+	if err := j.PrintStatus(ctx, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "CronJob photos: not applied") {
+		t.Errorf("status before apply:\n%s", out.String())
+	}
+	if err := j.Run(ctx, &out, nil, nil, false); err == nil {
+		t.Error("Run before apply succeeded")
+	}
+
+	if err := j.Apply(ctx, &out, testSettings("30 2 * * *"), false); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := j.Run(ctx, &out, []string{"snapshots", "list"}, []string{"-json"}, false); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := client.BatchV1().Jobs("backups").List(ctx, metav1.ListOptions{})
+	if err != nil || len(jobs.Items) != 1 {
+		t.Fatalf("Jobs = %v, %v; want one", jobs, err)
+	}
+	run := jobs.Items[0]
+	if !strings.Contains(out.String(), "Started "+run.Name) {
+		t.Errorf("Run wrote %q", out.String())
+	}
+	args := run.Spec.Template.Spec.Containers[0].Args
+	want := []string{"snapshots", "list", "-token-secret", "photos-token", "-json"}
+	if strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Errorf("run args = %q, want %q", args, want)
+	}
+	if run.Labels[commandLabel] != "snapshots" || metav1.GetControllerOf(&run) == nil {
+		t.Errorf("run labels %v, owner %v", run.Labels, run.OwnerReferences)
+	}
+
+	out.Reset()
+	if err := j.PrintStatus(ctx, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Token secret photos-token: missing", "CronJob photos: 30 2 * * *, concurrency Forbid", run.Name + "  snapshots  running"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("status lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	// Stopping twice is fine; the second has nothing left to remove.
+	for i := 0; i < 2; i++ {
+		if err := j.Stop(ctx); err != nil {
+			t.Fatalf("Stop, try %d: %v", i+1, err)
+		}
+	}
+	if _, err := client.BatchV1().CronJobs("backups").Get(ctx, "photos", metav1.GetOptions{}); err == nil {
+		t.Error("CronJob left after Stop")
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Get(ctx, "backups-photos", metav1.GetOptions{}); err == nil {
+		t.Error("PV left after Stop")
+	}
+}
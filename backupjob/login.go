@@ -0,0 +1,202 @@
+package backupjob
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+// LoginMode selects how the OAuth user token is obtained.
+type LoginMode string
+
+const (
+	// LoginAuto uses the browser when there is a display to open it on and
+	// the device flow otherwise, e.g. over SSH on a cluster node.
+	LoginAuto LoginMode = "auto"
+	// LoginBrowser opens the consent page and catches the redirect locally.
+	LoginBrowser LoginMode = "browser"
+	// LoginDevice prints a code to enter at a verification URL on any
+	// other device and polls until it is approved.
+	LoginDevice LoginMode = "device"
+)
+
+// LoginUsage is the help for the -login flag of setup and ui-test.
+const LoginUsage = "OAuth login: auto, browser or device (auto uses device when there is no display). " +
+	"The device login needs a \"TVs and Limited Input devices\" OAuth client and only grants access to the files it creates itself, " +
+	"so it cannot see backups made after a browser login"
+
+func ParseLoginMode(s string) (LoginMode, error) {
+	switch LoginMode(s) {
+	case LoginAuto, LoginBrowser, LoginDevice:
+		return LoginMode(s), nil
+	}
+	return "", fmt.Errorf("unknown login mode %q (want auto, browser or device)", s)
+}
+
+// resolve turns LoginAuto into a concrete mode.
+func (m LoginMode) resolve() LoginMode {
+	if m != LoginAuto && m != "" {
+		return m
+	}
+	if hasDisplay() {
+		return LoginBrowser
+	}
+	return LoginDevice
+}
+
+// hasDisplay reports whether a browser can be opened for the user. SSH
+// sessions without X forwarding have no DISPLAY on Linux; on other systems
+// an SSH session is taken to mean the desktop is somewhere else.
+func hasDisplay() bool {
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return os.Getenv("SSH_CONNECTION") == ""
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// getToken runs the login for the job's login mode.
+func (j *Job) getToken(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	if j.LoginMode.resolve() == LoginDevice {
+		return j.getTokenFromDevice(ctx, config)
+	}
+	return j.getTokenFromWeb(ctx, config)
+}
+
+// getTokenFromDevice runs the OAuth device authorization flow. Google only
+// grants the drive.file scope to devices, so the token can see the files
+// the backup creates with it but nothing else in the account, not even
+// backups made with a browser login, and the OAuth client must be of the
+// "TVs and Limited Input devices" type.
+func (j *Job) getTokenFromDevice(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	cfg := *config
+	if cfg.Endpoint.DeviceAuthURL == "" {
+		cfg.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	}
+	cfg.Scopes = []string{drive.DriveFileScope}
+
+	da, err := cfg.DeviceAuth(ctx)
+	if err != nil {
+		return nil, deviceAuthError(err)
+	}
+	j.notify(fmt.Sprintf("On any device, visit %s and enter the code %s\n\n"+
+		"The device login only grants access to the files the backup creates with it (the drive.file scope); "+
+		"it cannot see anything else in your Drive, including backups made after a browser login.\n\nWaiting for approval...", da.VerificationURI, da.UserCode))
+
+	tok, err := cfg.DeviceAccessToken(ctx, da)
+	if err != nil {
+		return nil, fmt.Errorf("device login failed: %v", err)
+	}
+	return tok, nil
+}
+
+// deviceAuthError explains the errors Google returns when the client in
+// credentials.json is not allowed to use the device flow.
+func deviceAuthError(err error) error {
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(re.Body, &body)
+		switch body.Error {
+		case "invalid_client", "unauthorized_client":
+			return fmt.Errorf("unable to start device login: the OAuth client in %s is not of the \"TVs and Limited Input devices\" type the device login needs; "+
+				"create one in the Google Cloud console or use -login browser (%s)", CredentialsFile, body.Error)
+		}
+	}
+	return fmt.Errorf("unable to start device login: %v", err)
+}
+
+// loginTimeout bounds how long the browser login waits for consent.
+const loginTimeout = 5 * time.Minute
+
+func (j *Job) getTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	l := &LoopbackLogin{Config: config, Timeout: loginTimeout, OpenURL: openBrowser, Notify: j.notify}
+	return l.Login(ctx)
+}
+
+// notify passes msg to the job's Notify hook, or prints it if there is
+// none.
+func (j *Job) notify(msg string) {
+	if j.Notify == nil {
+		fmt.Println(msg)
+		return
+	}
+	j.Notify(msg)
+}
+
+// getClient returns a client authorized with the job's saved token, logging
+// in first if there is none.
+func (j *Job) getClient(ctx context.Context, config *oauth2.Config) (*http.Client, error) {
+	tokFile := j.TokenFile()
+	tok, err := tokenFromFile(tokFile)
+	if err != nil {
+		tok, err = j.getToken(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveToken(tokFile, tok); err != nil {
+			return nil, err
+		}
+	}
+	return config.Client(ctx, tok), nil
+}
+
+// openBrowser opens url in the desktop's browser where we know how to.
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "linux":
+		if output, err := exec.Command("xdg-open", url).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v, output: %s", err, output)
+		}
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	}
+	return nil
+}
+
+func randToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func saveToken(path string, token *oauth2.Token) error {
+	// Jobs other than the default keep their token in their own directory.
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(token)
+}
+
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	t := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(t)
+	defer f.Close()
+	return t, err
+}
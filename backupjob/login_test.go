@@ -0,0 +1,103 @@
+package backupjob
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestParseLoginMode(t *testing.T) {
+	for _, s := range []string{"auto", "browser", "device"} {
+		if m, err := ParseLoginMode(s); err != nil || string(m) != s {
+			t.Errorf("ParseLoginMode(%q) = %q, %v", s, m, err)
+		}
+	}
+	if _, err := ParseLoginMode("oob"); err == nil {
+		t.Error("ParseLoginMode(oob) succeeded")
+	}
+}
+
+// newDeviceServer serves the device code and token endpoints, answering
+// the device code request with status and body.
+func newDeviceServer(t *testing.T, status int, body string) (*httptest.Server, *oauth2.Config, *[]string) {
+	t.Helper()
+	var scopes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			scopes = append(scopes, r.Form.Get("scope"))
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		case "/token":
+			if r.Form.Get("device_code") != "dc" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"at","refresh_token":"rt","token_type":"Bearer","expires_in":3600}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	config := &oauth2.Config{
+		ClientID: "id",
+		Scopes:   []string{drive.DriveScope},
+		Endpoint: oauth2.Endpoint{DeviceAuthURL: srv.URL + "/device", TokenURL: srv.URL + "/token"},
+	}
+	return srv, config, &scopes
+}
+
+func TestDeviceLogin(t *testing.T) {
+	_, config, scopes := newDeviceServer(t, http.StatusOK,
+		`{"device_code":"dc","user_code":"ABCD-EFGH","verification_url":"https://www.google.com/device","expires_in":60,"interval":1}`)
+	var notes []string
+	j := &Job{Notify: func(msg string) { notes = append(notes, msg) }}
+	tok, err := j.getTokenFromDevice(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "at" || tok.RefreshToken != "rt" {
+		t.Errorf("token = %+v", tok)
+	}
+	if len(*scopes) != 1 || (*scopes)[0] != drive.DriveFileScope {
+		t.Errorf("requested scopes %q, want %s", *scopes, drive.DriveFileScope)
+	}
+	if len(notes) != 1 {
+		t.Fatalf("notified %q, want one message", notes)
+	}
+	for _, want := range []string{"https://www.google.com/device", "ABCD-EFGH", "drive.file"} {
+		if !strings.Contains(notes[0], want) {
+			t.Errorf("login message lacks %q:\n%s", want, notes[0])
+		}
+	}
+}
+
+func TestDeviceLoginErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"desktop client", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"Invalid client type."}`, "TVs and Limited Input devices"},
+		{"unauthorized client", http.StatusBadRequest, `{"error":"unauthorized_client"}`, "TVs and Limited Input devices"},
+		{"other error", http.StatusInternalServerError, `{"error":"internal_failure"}`, "unable to start device login: oauth2:"},
+		{"not json", http.StatusBadGateway, `bad gateway`, "unable to start device login: oauth2:"},
+	}
+	for _, tt := range tests {
+		_, config, _ := newDeviceServer(t, tt.status, tt.body)
+		j := &Job{Notify: func(msg string) { t.Errorf("%s: notified %q", tt.name, msg) }}
+		_, err := j.getTokenFromDevice(context.Background(), config)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.want)
+		}
+	}
+}
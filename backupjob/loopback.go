@@ -0,0 +1,143 @@
+package backupjob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// errLoginTimeout means nobody completed the consent page in time.
+var errLoginTimeout = errors.New("timed out waiting for the browser login")
+
+// oauthError is an error the authorization server reported on the redirect,
+// such as access_denied when the user declines.
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("authorization failed: %s: %s", e.Code, e.Description)
+	}
+	return "authorization failed: " + e.Code
+}
+
+// LoopbackLogin runs the authorization code flow for installed apps: it
+// listens on a random loopback port, sends the user to the consent page and
+// exchanges the code the browser is redirected back with. It uses its own
+// server and mux, so it can run any number of times in one process.
+type LoopbackLogin struct {
+	Config *oauth2.Config
+	// Timeout bounds the wait for the redirect; zero means no limit
+	// beyond the context.
+	Timeout time.Duration
+	// OpenURL shows the consent page to the user, typically by opening a
+	// browser. The login proceeds if it fails, since the URL is shown
+	// with Notify too.
+	OpenURL func(authURL string) error
+	// Notify shows msg to the user; nil prints it to stdout.
+	Notify func(msg string)
+}
+
+type loginResult struct {
+	code string
+	err  error
+}
+
+// Login returns a token for the account the user consents with.
+func (l *LoopbackLogin) Login(ctx context.Context) (*oauth2.Token, error) {
+	if l.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.Timeout)
+		defer cancel()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for the login redirect: %v", err)
+	}
+	cfg := *l.Config
+	cfg.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/", ln.Addr().(*net.TCPAddr).Port)
+
+	state := randToken()
+	verifier := oauth2.GenerateVerifier()
+	authURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+
+	results := make(chan loginResult, 1)
+	finish := func(res loginResult) {
+		select {
+		case results <- res:
+		default:
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		switch {
+		case q.Get("state") != state:
+			// Not the answer to our request, perhaps a stale tab or
+			// another local process; keep waiting for the real one.
+			http.Error(w, "Invalid state.", http.StatusBadRequest)
+		case q.Get("error") != "":
+			http.Error(w, "Authorization failed. You can close this tab now.", http.StatusForbidden)
+			finish(loginResult{err: &oauthError{Code: q.Get("error"), Description: q.Get("error_description")}})
+		case q.Get("code") == "":
+			http.Error(w, "Missing authorization code.", http.StatusBadRequest)
+		default:
+			w.Write([]byte("Authorization successful! You can close this tab now."))
+			finish(loginResult{code: q.Get("code")})
+		}
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	l.notify("Complete the login in your browser. If it did not open, visit:\n\n" + authURL)
+	if l.OpenURL != nil {
+		if err := l.OpenURL(authURL); err != nil {
+			l.notify(fmt.Sprintf("Unable to open browser: %v\n\nVisit this URL to log in:\n\n%s", err, authURL))
+		}
+	}
+
+	var res loginResult
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errLoginTimeout
+		}
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	tok, err := cfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("unable to exchange authorization code: %w", err)
+	}
+	return tok, nil
+}
+
+func (l *LoopbackLogin) notify(msg string) {
+	if l.Notify == nil {
+		fmt.Println(msg)
+		return
+	}
+	l.Notify(msg)
+}
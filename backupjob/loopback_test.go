@@ -0,0 +1,105 @@
+package backupjob
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newLoopbackLogin returns a login against a token endpoint that accepts the
+// code "good", with redirect answering the consent page in place of the
+// user's browser.
+func newLoopbackLogin(t *testing.T, redirect func(redirectURL, state string)) (*LoopbackLogin, *[]string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("code") != "good" || r.Form.Get("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"at","refresh_token":"rt","token_type":"Bearer","expires_in":3600}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	var notes []string
+	l := &LoopbackLogin{
+		Config: &oauth2.Config{
+			ClientID: "id",
+			Endpoint: oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+		},
+		Timeout: 10 * time.Second,
+		OpenURL: func(authURL string) error {
+			u, err := url.Parse(authURL)
+			if err != nil {
+				return err
+			}
+			q := u.Query()
+			go redirect(q.Get("redirect_uri"), q.Get("state"))
+			return nil
+		},
+		Notify: func(msg string) { notes = append(notes, msg) },
+	}
+	return l, &notes
+}
+
+// visit sends the browser's request for the redirect with query and returns
+// the status it was answered with.
+func visit(t *testing.T, redirectURL string, query url.Values) int {
+	t.Helper()
+	res, err := http.Get(redirectURL + "?" + query.Encode())
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestLoopbackLogin(t *testing.T) {
+	l, notes := newLoopbackLogin(t, func(redirectURL, state string) {
+		visit(t, redirectURL, url.Values{"state": {state}, "code": {"good"}})
+	})
+	tok, err := l.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "at" {
+		t.Errorf("token = %+v", tok)
+	}
+	// The consent URL goes to Notify, not stdout, so a TUI can show it.
+	if len(*notes) != 1 || !strings.Contains((*notes)[0], l.Config.Endpoint.AuthURL) {
+		t.Errorf("notified %q, want the consent URL", *notes)
+	}
+}
+
+// TestLoopbackLoginBadState checks a redirect without this login's state is
+// turned away without ending the login, so the real one still completes it.
+func TestLoopbackLoginBadState(t *testing.T) {
+	l, _ := newLoopbackLogin(t, func(redirectURL, state string) {
+		for _, q := range []url.Values{
+			{"code": {"bad"}},
+			{"state": {"stale"}, "code": {"bad"}},
+			{"state": {"stale"}, "error": {"access_denied"}},
+		} {
+			if status := visit(t, redirectURL, q); status != http.StatusBadRequest {
+				t.Errorf("redirect with %v answered %d, want %d", q, status, http.StatusBadRequest)
+			}
+		}
+		visit(t, redirectURL, url.Values{"state": {state}, "code": {"good"}})
+	})
+	tok, err := l.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "at" {
+		t.Errorf("token = %+v", tok)
+	}
+}
@@ -0,0 +1,10 @@
+{{/* The PV is cluster-wide, so its name starts with the namespace; the
+     default job in the default namespace keeps the name it had before
+     jobs had names. Config.Names works the name out the same way. */}}
+{{- define "drive-backup.pvName" -}}
+{{- if and (eq .Release.Namespace "default") (eq .Values.names.pvBase "backup-pv") -}}
+backup-pv
+{{- else -}}
+{{ .Release.Namespace }}-{{ .Values.names.pvBase }}
+{{- end -}}
+{{- end -}}
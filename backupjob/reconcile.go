@@ -0,0 +1,254 @@
+package backupjob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// planAction is what reconciling does to one object.
+type planAction string
+
+const (
+	actionCreate    planAction = "create"
+	actionUpdate    planAction = "update"
+	actionRecreate  planAction = "recreate"
+	actionUnchanged planAction = "unchanged"
+)
+
+// plannedChange is the action for one object and the fields behind it.
+type plannedChange struct {
+	Object *manifestObject
+	Action planAction
+	Fields []string
+}
+
+// deleteTimeout bounds the wait for an object being recreated to go away,
+// e.g. for a PVC whose backup Job is still running.
+const deleteTimeout = 2 * time.Minute
+
+// plan compares the objects in manifests with the live ones.
+func (k *kubeApplier) plan(ctx context.Context, manifests ...string) ([]plannedChange, error) {
+	var plan []plannedChange
+	for _, m := range manifests {
+		objs, err := k.decodeManifests(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			c, err := planObject(ctx, obj)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, c)
+		}
+	}
+	linkStorage(plan)
+	return plan, nil
+}
+
+func planObject(ctx context.Context, obj *manifestObject) (plannedChange, error) {
+	c := plannedChange{Object: obj}
+	live, err := obj.get(ctx)
+	if apierrors.IsNotFound(err) {
+		c.Action = actionCreate
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("error reading %s %s: %v", obj.Kind, obj.Name, err)
+	}
+	liveMap, err := toJSONMap(live)
+	if err != nil {
+		return c, err
+	}
+
+	c.Action = actionUnchanged
+	diffs := diffFields(obj.desired, liveMap, "")
+	// Only fields desired sets are compared, so look for optional ones it
+	// has dropped separately.
+	for _, f := range obj.optional {
+		if lookupField(obj.desired, f) == nil && lookupField(liveMap, f) != nil {
+			diffs = append(diffs, f)
+		}
+	}
+	for _, f := range diffs {
+		if f == "apiVersion" || f == "kind" {
+			// Typed clients leave these empty on objects they read.
+			continue
+		}
+		c.Fields = append(c.Fields, f)
+		if isImmutable(obj, f) {
+			c.Action = actionRecreate
+		} else if c.Action == actionUnchanged {
+			c.Action = actionUpdate
+		}
+	}
+	return c, nil
+}
+
+// diffFields lists the paths at which live differs from desired. Only the
+// fields desired sets are compared, since the server fills in defaults for
+// the rest.
+func diffFields(desired, live interface{}, path string) []string {
+	var diffs []string
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return []string{path}
+		}
+		keys := make([]string, 0, len(d))
+		for key := range d {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			diffs = append(diffs, diffFields(d[key], l[key], p)...)
+		}
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return []string{path}
+		}
+		for i := range d {
+			diffs = append(diffs, diffFields(d[i], l[i], fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case nil:
+	default:
+		// An explicit zero value matches a field the server omits.
+		if live == nil && reflect.ValueOf(desired).IsZero() {
+			return nil
+		}
+		if !reflect.DeepEqual(desired, live) {
+			return []string{path}
+		}
+	}
+	return diffs
+}
+
+// lookupField returns the value at a dotted path, or nil.
+func lookupField(obj map[string]interface{}, path string) interface{} {
+	var v interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func isImmutable(obj *manifestObject, field string) bool {
+	for _, p := range obj.immutable {
+		if field == p || strings.HasPrefix(field, p+".") || strings.HasPrefix(field, p+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// linkStorage recreates the PV and PVC together. A new PV cannot be bound
+// while the old claim holds its name, and a new claim cannot bind a
+// retained PV that still remembers the old one.
+func linkStorage(plan []plannedChange) {
+	recreate := false
+	for _, c := range plan {
+		if c.Action == actionRecreate && isStorage(c.Object) {
+			recreate = true
+		}
+	}
+	if !recreate {
+		return
+	}
+	for i := range plan {
+		c := &plan[i]
+		if isStorage(c.Object) && (c.Action == actionUpdate || c.Action == actionUnchanged) {
+			c.Action = actionRecreate
+			c.Fields = append(c.Fields, "(bound volume is recreated)")
+		}
+	}
+}
+
+func isStorage(obj *manifestObject) bool {
+	return obj.Kind == "PersistentVolume" || obj.Kind == "PersistentVolumeClaim"
+}
+
+// printPlan writes one line per object, with the changed fields.
+func printPlan(w io.Writer, plan []plannedChange) {
+	symbols := map[planAction]string{
+		actionCreate:    "+",
+		actionUpdate:    "~",
+		actionRecreate:  "-/+",
+		actionUnchanged: "=",
+	}
+	fmt.Fprintln(w, "Planned changes:")
+	for _, c := range plan {
+		fmt.Fprintf(w, "  %-3s %s %s (%s)", symbols[c.Action], c.Object.Kind, c.Object.Name, c.Action)
+		if len(c.Fields) > 0 {
+			fmt.Fprintf(w, ": %s", strings.Join(c.Fields, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// execute carries out a plan, writing each object it applies to w. Objects
+// being recreated are deleted first, in reverse order so claims go before
+// their volumes, and everything that changed is then applied in order.
+func (k *kubeApplier) execute(ctx context.Context, w io.Writer, plan []plannedChange) error {
+	for i := len(plan) - 1; i >= 0; i-- {
+		c := plan[i]
+		if c.Action != actionRecreate {
+			continue
+		}
+		if err := deleteAndWait(ctx, c.Object); err != nil {
+			return err
+		}
+	}
+	for _, c := range plan {
+		if c.Action == actionUnchanged {
+			continue
+		}
+		if err := c.Object.apply(ctx, k.applyOptions()); err != nil {
+			return fmt.Errorf("error applying %s %s: %v", c.Object.Kind, c.Object.Name, err)
+		}
+		fmt.Fprintf(w, "Applied %s %s\n", c.Object.Kind, c.Object.Name)
+	}
+	return nil
+}
+
+// deleteAndWait deletes obj and waits until it is gone, since finalizers
+// such as PVC protection can hold it for a while.
+func deleteAndWait(ctx context.Context, obj *manifestObject) error {
+	if err := obj.delete(ctx); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting %s %s: %v", obj.Kind, obj.Name, err)
+	}
+	deadline := time.Now().Add(deleteTimeout)
+	for {
+		_, err := obj.get(ctx)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s %s: %v", obj.Kind, obj.Name, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s %s is still being deleted after %v; is a backup Job still using it?", obj.Kind, obj.Name, deleteTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
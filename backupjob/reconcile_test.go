@@ -0,0 +1,187 @@
+package backupjob
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired interface{}
+		live    interface{}
+		want    []string
+	}{
+		{"equal", map[string]interface{}{"a": "x", "n": 1.0}, map[string]interface{}{"a": "x", "n": 1.0}, nil},
+		{"changed value", map[string]interface{}{"a": "x"}, map[string]interface{}{"a": "y"}, []string{"a"}},
+		{"missing in live", map[string]interface{}{"a": "x"}, map[string]interface{}{}, []string{"a"}},
+		{"server defaults ignored", map[string]interface{}{"a": "x"}, map[string]interface{}{"a": "x", "b": "default"}, nil},
+		{"zero value matches omitted", map[string]interface{}{"s": "", "n": 0.0, "b": false}, map[string]interface{}{}, nil},
+		{"zero value differs from set", map[string]interface{}{"s": ""}, map[string]interface{}{"s": "x"}, []string{"s"}},
+		{
+			"nested paths sorted",
+			map[string]interface{}{"spec": map[string]interface{}{"z": 1.0, "a": map[string]interface{}{"b": true}}},
+			map[string]interface{}{"spec": map[string]interface{}{"z": 2.0, "a": map[string]interface{}{"b": false}}},
+			[]string{"spec.a.b", "spec.z"},
+		},
+		{
+			"list element",
+			map[string]interface{}{"l": []interface{}{map[string]interface{}{"n": "a"}, map[string]interface{}{"n": "b"}}},
+			map[string]interface{}{"l": []interface{}{map[string]interface{}{"n": "a"}, map[string]interface{}{"n": "c"}}},
+			[]string{"l[1].n"},
+		},
+		{"list length", map[string]interface{}{"l": []interface{}{"a"}}, map[string]interface{}{"l": []interface{}{"a", "b"}}, []string{"l"}},
+		{"map replaced by scalar", map[string]interface{}{"m": map[string]interface{}{"a": "x"}}, map[string]interface{}{"m": "x"}, []string{"m"}},
+		{"list replaced by scalar", map[string]interface{}{"l": []interface{}{"a"}}, map[string]interface{}{"l": "a"}, []string{"l"}},
+		{"nil desired", map[string]interface{}{"a": nil}, map[string]interface{}{"a": "x"}, nil},
+	}
+	for _, tt := range tests {
+		if got := diffFields(tt.desired, tt.live, ""); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffFields = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	daily := testSettings("@daily").Schedule
+	hourly := testSettings("@hourly").Schedule
+	zoned := daily
+	zoned.TimeZone = "Europe/Berlin"
+	withDeadline := daily
+	withDeadline.StartingDeadlineSeconds = 300
+
+	tests := []struct {
+		name     string
+		applied  *Schedule // applied first with host path /data/a, if set
+		schedule Schedule
+		hostPath string
+		// changes are the objects expected to change, as
+		// "action: fields"; every other object is unchanged.
+		changes map[string]string
+	}{
+		{
+			name:     "nothing applied",
+			schedule: daily,
+			hostPath: "/data/a",
+			changes: map[string]string{
+				"ServiceAccount photos":           "create: ",
+				"Role photos-token":               "create: ",
+				"RoleBinding photos-token":        "create: ",
+				"PersistentVolume backups-photos": "create: ",
+				"PersistentVolumeClaim photos":    "create: ",
+				"CronJob photos":                  "create: ",
+			},
+		},
+		{name: "no change", applied: &daily, schedule: daily, hostPath: "/data/a"},
+		{
+			name:     "new schedule",
+			applied:  &daily,
+			schedule: hourly,
+			hostPath: "/data/a",
+			changes:  map[string]string{"CronJob photos": "update: spec.schedule"},
+		},
+		{
+			name:     "time zone added",
+			applied:  &daily,
+			schedule: zoned,
+			hostPath: "/data/a",
+			changes:  map[string]string{"CronJob photos": "update: spec.timeZone"},
+		},
+		{
+			name:     "time zone dropped",
+			applied:  &zoned,
+			schedule: daily,
+			hostPath: "/data/a",
+			changes:  map[string]string{"CronJob photos": "update: spec.timeZone"},
+		},
+		{
+			name:     "deadline dropped",
+			applied:  &withDeadline,
+			schedule: daily,
+			hostPath: "/data/a",
+			changes:  map[string]string{"CronJob photos": "update: spec.startingDeadlineSeconds"},
+		},
+		{
+			name:     "new host path",
+			applied:  &daily,
+			schedule: daily,
+			hostPath: "/data/b",
+			changes: map[string]string{
+				"PersistentVolume backups-photos": "recreate: spec.hostPath.path",
+				"PersistentVolumeClaim photos":    "recreate: (bound volume is recreated)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			j, _ := newTestJob(t)
+			if tt.applied != nil {
+				manifests, err := j.Manifests(*tt.applied, "/data/a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				plan, err := j.kube.plan(ctx, manifests...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := j.kube.execute(ctx, &strings.Builder{}, plan); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			manifests, err := j.Manifests(tt.schedule, tt.hostPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan, err := j.kube.plan(ctx, manifests...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan) != 6 {
+				t.Errorf("plan has %d objects, want 6", len(plan))
+			}
+			for _, c := range plan {
+				key := c.Object.Kind + " " + c.Object.Name
+				got := string(c.Action) + ": " + strings.Join(c.Fields, ", ")
+				want, ok := tt.changes[key]
+				if !ok {
+					want = "unchanged: "
+				}
+				if got != want {
+					t.Errorf("%s: %s, want %s", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestExecuteOutput checks the plan and what was applied both go to the
+// writer Apply is given, which ui-test shows in its form.
+func TestExecuteOutput(t *testing.T) {
+	j, _ := newTestJob(t)
+	var out strings.Builder
+	if err := j.Apply(context.Background(), &out, testSettings("@daily"), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Planned changes:\n",
+		"  +   CronJob photos (create)\n",
+		"Applied ServiceAccount photos\n",
+		"Applied CronJob photos\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := j.Apply(context.Background(), &out, testSettings("@daily"), false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Applied") {
+		t.Errorf("unchanged objects were applied again:\n%s", out.String())
+	}
+}
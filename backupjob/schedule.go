@@ -0,0 +1,122 @@
+package backupjob
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule is when the CronJob runs and how runs may overlap.
+type Schedule struct {
+	// Cron is a 5-field cron expression or a macro such as @daily.
+	Cron string `json:"cron"`
+	// TimeZone is an IANA zone name such as Europe/Berlin; empty means
+	// the time zone of the cluster's controller manager, usually UTC.
+	TimeZone string `json:"timeZone"`
+	// ConcurrencyPolicy is Allow, Forbid or Replace. Forbid, the default,
+	// keeps a slow backup from racing the next one over the manifest.
+	ConcurrencyPolicy string `json:"concurrencyPolicy"`
+	// StartingDeadlineSeconds is how late a missed run may still start;
+	// zero leaves it unset.
+	StartingDeadlineSeconds int64 `json:"startingDeadlineSeconds"`
+}
+
+const DefaultConcurrencyPolicy = "Forbid"
+
+// ParseScheduleInput reads a schedule as typed by the user. A plain number
+// is the old "every N minutes" setting and is turned into an equivalent
+// expression where there is one.
+func ParseScheduleInput(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	n, err := strconv.Atoi(input)
+	if err != nil {
+		return input, nil
+	}
+	switch {
+	case n >= 1 && n < 60:
+		return fmt.Sprintf("*/%d * * * *", n), nil
+	case n == 60:
+		return "@hourly", nil
+	case n > 60 && n < 24*60 && n%60 == 0 && (24*60)%n == 0:
+		return fmt.Sprintf("0 */%d * * *", n/60), nil
+	case n == 24*60:
+		return "@daily", nil
+	}
+	return "", fmt.Errorf("every %d minutes cannot be written as a cron schedule; use a cron expression instead", n)
+}
+
+// Validate checks the schedule the way the CronJob controller will. Errors
+// name the config file field at fault.
+func (s Schedule) Validate() error {
+	if strings.Contains(s.Cron, "TZ=") {
+		return FieldErrorf("cron", "schedule %q: set the time zone separately instead of with TZ=", s.Cron)
+	}
+	if _, err := cron.ParseStandard(s.Cron); err != nil {
+		return FieldErrorf("cron", "invalid schedule %q: %v", s.Cron, err)
+	}
+	if _, err := s.location(); err != nil {
+		return InField("timeZone", err)
+	}
+	switch s.ConcurrencyPolicy {
+	case "Allow", "Forbid", "Replace":
+	default:
+		return FieldErrorf("concurrencyPolicy", "unknown concurrency policy %q (want Allow, Forbid or Replace)", s.ConcurrencyPolicy)
+	}
+	if s.StartingDeadlineSeconds < 0 {
+		return FieldErrorf("startingDeadlineSeconds", "starting deadline must not be negative")
+	}
+	return nil
+}
+
+func (s Schedule) location() (*time.Location, error) {
+	if s.TimeZone == "" {
+		return time.UTC, nil
+	}
+	if s.TimeZone == "Local" {
+		return nil, fmt.Errorf("time zone must be an IANA name such as Europe/Berlin, not Local")
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", s.TimeZone)
+	}
+	return loc, nil
+}
+
+// nextRuns returns the next n times the schedule fires after from, in the
+// schedule's time zone.
+func (s Schedule) nextRuns(from time.Time, n int) ([]time.Time, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	sched, _ := cron.ParseStandard(s.Cron)
+	loc, _ := s.location()
+	t := from.In(loc)
+	var runs []time.Time
+	for i := 0; i < n; i++ {
+		t = sched.Next(t)
+		if t.IsZero() {
+			break
+		}
+		runs = append(runs, t)
+	}
+	return runs, nil
+}
+
+// PreviewRuns describes the next n runs, or why there are none.
+func (s Schedule) PreviewRuns(n int) string {
+	runs, err := s.nextRuns(time.Now(), n)
+	if err != nil {
+		return err.Error()
+	}
+	if len(runs) == 0 {
+		return "The schedule never fires."
+	}
+	var b strings.Builder
+	for _, t := range runs {
+		fmt.Fprintf(&b, "%s\n", t.Format("Mon 2006-01-02 15:04 MST"))
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package backupjob
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleInput(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"15", "*/15 * * * *", false},
+		{" 59\n", "*/59 * * * *", false},
+		{"60", "@hourly", false},
+		{"120", "0 */2 * * *", false},
+		{"1440", "@daily", false},
+		{"90", "", true},
+		{"300", "", true},
+		{"0", "", true},
+		{"30 2 * * *", "30 2 * * *", false},
+		{"@weekly", "@weekly", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseScheduleInput(tt.input)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseScheduleInput(%q) = %q, %v; want %q, error %v", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	ok := Schedule{Cron: "30 2 * * 1-5", TimeZone: "Europe/Berlin", ConcurrencyPolicy: "Replace", StartingDeadlineSeconds: 60}
+	tests := []struct {
+		name string
+		edit func(*Schedule)
+		want string // field named in the error, empty if valid
+	}{
+		{"valid", func(s *Schedule) {}, ""},
+		{"macro", func(s *Schedule) { s.Cron = "@daily" }, ""},
+		{"six fields", func(s *Schedule) { s.Cron = "0 30 2 * * *" }, "cron"},
+		{"minute out of range", func(s *Schedule) { s.Cron = "61 * * * *" }, "cron"},
+		{"TZ prefix", func(s *Schedule) { s.Cron = "TZ=UTC 0 * * * *" }, "cron"},
+		{"unknown zone", func(s *Schedule) { s.TimeZone = "Mars/Olympus" }, "timeZone"},
+		{"local zone", func(s *Schedule) { s.TimeZone = "Local" }, "timeZone"},
+		{"policy", func(s *Schedule) { s.ConcurrencyPolicy = "forbid" }, "concurrencyPolicy"},
+		{"negative deadline", func(s *Schedule) { s.StartingDeadlineSeconds = -1 }, "startingDeadlineSeconds"},
+	}
+	for _, tt := range tests {
+		s := ok
+		tt.edit(&s)
+		err := s.Validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want+":") {
+			t.Errorf("%s: error = %v, want one naming %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNextRuns(t *testing.T) {
+	from := time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC) // a Friday
+	tests := []struct {
+		s    Schedule
+		want []string
+	}{
+		{
+			Schedule{Cron: "30 2 * * *", ConcurrencyPolicy: "Forbid"},
+			[]string{"2024-03-30 02:30 UTC", "2024-03-31 02:30 UTC"},
+		},
+		{
+			Schedule{Cron: "0 9 * * 1-5", ConcurrencyPolicy: "Forbid"},
+			[]string{"2024-04-01 09:00 UTC", "2024-04-02 09:00 UTC"},
+		},
+		{
+			// Berlin moves to summer time on 31 March.
+			Schedule{Cron: "30 2 * * *", TimeZone: "Europe/Berlin", ConcurrencyPolicy: "Forbid"},
+			[]string{"2024-03-30 02:30 CET", "2024-04-01 02:30 CEST"},
+		},
+		{
+			Schedule{Cron: "0 0 30 2 *", ConcurrencyPolicy: "Forbid"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		runs, err := tt.s.nextRuns(from, 2)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s.Cron, err)
+			continue
+		}
+		var got []string
+		for _, r := range runs {
+			got = append(got, r.Format("2006-01-02 15:04 MST"))
+		}
+		if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("%q in %q: runs %v, want %v", tt.s.Cron, tt.s.TimeZone, got, tt.want)
+		}
+	}
+
+	if _, err := (Schedule{Cron: "bad"}).nextRuns(from, 2); err == nil {
+		t.Error("nextRuns accepted an invalid schedule")
+	}
+}
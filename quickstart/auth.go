@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+// authMode selects how the Drive backend gets its access tokens.
+type authMode string
+
+const (
+	// authAuto uses a service account key if one is mounted and falls
+	// back to the OAuth user token otherwise.
+	authAuto authMode = "auto"
+	// authOAuth uses a personal account's token from the browser login.
+	authOAuth authMode = "oauth"
+	// authServiceAccount signs tokens with a service account JSON key,
+	// optionally impersonating a user through domain-wide delegation.
+	authServiceAccount authMode = "service-account"
+	// authMetadata asks the GCE/GKE metadata server, which is how
+	// Workload Identity hands out credentials.
+	authMetadata authMode = "metadata"
+)
+
+func parseAuthMode(s string) (authMode, error) {
+	switch authMode(s) {
+	case authAuto, authOAuth, authServiceAccount, authMetadata:
+		return authMode(s), nil
+	}
+	return "", fmt.Errorf("unknown auth mode %q (want auto, oauth, service-account or metadata)", s)
+}
+
+// authOptions says where Drive credentials come from.
+type authOptions struct {
+	Mode authMode
+	// CredentialsFile and TokenFile are the OAuth client and user token
+	// for personal accounts.
+	CredentialsFile string
+	TokenFile       string
+	// KeyFile is a service account JSON key; Subject, if set, is the
+	// Workspace user it impersonates.
+	KeyFile string
+	Subject string
+	// Interactive allows the browser login when there is no OAuth token
+	// yet. It is never used for service accounts or the metadata server.
+	Interactive bool
+	// TokenSecret is the Kubernetes Secret TokenFile is mounted from.
+	// Inside a cluster, refreshed tokens are written back to it so the
+	// next run starts from them; elsewhere they go to TokenFile.
+	TokenSecret string
+}
+
+// errTokenRevoked means Google refused to refresh the OAuth token because
+// it was revoked or has expired; only a new login fixes that.
+var errTokenRevoked = errors.New("OAuth refresh token was revoked or has expired; run setup to log in again")
+
+// tokenSource returns the token source for the configured mode.
+func (o authOptions) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	mode := o.Mode
+	if mode == authAuto || mode == "" {
+		mode = authOAuth
+		if _, err := os.Stat(o.KeyFile); err == nil {
+			mode = authServiceAccount
+		}
+	}
+
+	switch mode {
+	case authServiceAccount:
+		b, err := os.ReadFile(o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read service account key: %v", err)
+		}
+		cfg, err := google.JWTConfigFromJSON(b, drive.DriveScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse service account key: %v", err)
+		}
+		cfg.Subject = o.Subject
+		return cfg.TokenSource(ctx), nil
+	case authMetadata:
+		return google.ComputeTokenSource("", drive.DriveScope), nil
+	case authOAuth:
+		b, err := os.ReadFile(o.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client secret file: %v", err)
+		}
+		config, err := google.ConfigFromJSON(b, drive.DriveScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+		}
+		tok, err := tokenFromFile(o.TokenFile)
+		if err != nil {
+			if !o.Interactive {
+				return nil, fmt.Errorf("no OAuth token in %s; log in with setup first or use a service account", o.TokenFile)
+			}
+			if tok, err = getTokenFromWeb(config); err != nil {
+				return nil, err
+			}
+			saveToken(o.TokenFile, tok)
+		}
+		return &savingTokenSource{base: config.TokenSource(ctx, tok), last: tok, save: o.tokenSaver()}, nil
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", mode)
+}
+
+// tokenSaver returns where refreshed OAuth tokens are persisted: the token
+// Secret when running in a cluster, the token file otherwise.
+func (o authOptions) tokenSaver() func(*oauth2.Token) error {
+	if o.TokenSecret != "" {
+		kube, err := inClusterClient()
+		if err == nil {
+			return func(tok *oauth2.Token) error {
+				b, err := json.Marshal(tok)
+				if err != nil {
+					return err
+				}
+				return kube.patchSecretData(o.TokenSecret, map[string][]byte{"token.json": b})
+			}
+		}
+		if !errors.Is(err, errNotInCluster) {
+			log.Printf("Refreshed OAuth tokens will not be saved: %v", err)
+			return nil
+		}
+	}
+	return func(tok *oauth2.Token) error {
+		b, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(o.TokenFile, b, 0600)
+	}
+}
+
+// savingTokenSource hands out base's tokens and saves each one that differs
+// from the last, which is how a refresh shows up. It also tells revocation
+// apart from other refresh failures.
+type savingTokenSource struct {
+	base oauth2.TokenSource
+	save func(*oauth2.Token) error
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		var rerr *oauth2.RetrieveError
+		if errors.As(err, &rerr) && rerr.ErrorCode == "invalid_grant" {
+			return nil, fmt.Errorf("%w: %v", errTokenRevoked, err)
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil && tok.AccessToken == s.last.AccessToken && tok.RefreshToken == s.last.RefreshToken {
+		return tok, nil
+	}
+	s.last = tok
+	if s.save != nil {
+		if err := s.save(tok); err != nil {
+			log.Printf("Unable to save refreshed OAuth token: %v", err)
+		} else {
+			log.Printf("Saved refreshed OAuth token")
+		}
+	}
+	return tok, nil
+}
+
+// isTerminal reports whether stdin is attached to a terminal, i.e. someone
+// is there to complete a browser login.
+func isTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// rootFolderID names the top level of every backend; the backup folder is
+// created directly inside it.
+const rootFolderID = "root"
+
+var errNotFound = errors.New("not found")
+
+// errHeadRevision is returned when deleting the revision a file currently
+// has, which lives as long as the file does.
+var errHeadRevision = errors.New("revision is the file's current content")
+
+// object is a file or folder stored in a Backend.
+type object struct {
+	ID       string
+	Name     string
+	Folder   bool
+	Size     int64
+	ModTime  time.Time
+	MD5      string
+	Revision string
+	// Native marks Google Docs and similar files, which have no
+	// downloadable contents.
+	Native bool
+}
+
+// Backend is the storage the backup, restore and snapshot code runs
+// against. Objects are addressed by opaque IDs handed out by the backend;
+// folders nest like directories, starting from rootFolderID.
+type Backend interface {
+	// Stat looks up the file or folder called name directly inside
+	// parentID and returns nil if there is none.
+	Stat(parentID, name string, folder bool) (*object, error)
+	// List returns the files and folders directly inside folderID.
+	List(folderID string) ([]*object, error)
+	// Mkdir returns the folder called name inside parentID, creating it
+	// if it does not exist yet.
+	Mkdir(parentID, name string) (string, error)
+	// Upload stores media as a new file called name in parentID, or as
+	// the new contents of fileID if that is set. Replacing a file that
+	// no longer exists fails with an error isNotFound accepts.
+	Upload(parentID, name, fileID string, media io.Reader, modTime time.Time) (*object, error)
+	// Move renames id and moves it from oldParentID to newParentID. It
+	// returns the object's ID afterwards, which may differ from id.
+	Move(id, oldParentID, newParentID, name string) (string, error)
+	Download(id string) (io.ReadCloser, error)
+	DownloadRange(id string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes id, or moves it to the trash if trash is set.
+	Delete(id string, trash bool) error
+}
+
+// revisionStore is implemented by backends that keep old versions of a file
+// when it is replaced, which lets mirrored snapshots restore them.
+type revisionStore interface {
+	PinRevision(fileID, revisionID string) error
+	DownloadRevision(fileID, revisionID string) (io.ReadCloser, error)
+	// DeleteRevision fails with errHeadRevision for the file's current
+	// revision.
+	DeleteRevision(fileID, revisionID string) error
+}
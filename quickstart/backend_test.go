@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackend checks store against the Backend contract.
+func testBackend(t *testing.T, store Backend) {
+	t.Helper()
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	folder, err := store.Mkdir(rootFolderID, "backup")
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if again, err := store.Mkdir(rootFolderID, "backup"); err != nil || again != folder {
+		t.Errorf("Mkdir of an existing folder = %q, %v; want %q", again, err, folder)
+	}
+	if o, err := store.Stat(rootFolderID, "backup", true); err != nil || o == nil || !o.Folder || o.ID != folder {
+		t.Errorf("Stat of the folder = %+v, %v", o, err)
+	}
+	if o, err := store.Stat(rootFolderID, "backup", false); err != nil || o != nil {
+		t.Errorf("Stat of the folder as a file = %+v, %v; want nil", o, err)
+	}
+	if o, err := store.Stat(folder, "missing.txt", false); err != nil || o != nil {
+		t.Errorf("Stat of a missing file = %+v, %v; want nil", o, err)
+	}
+
+	obj, err := store.Upload(folder, "a.txt", "", strings.NewReader("hello world"), mtime)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	sum := md5.Sum([]byte("hello world"))
+	if obj.Size != 11 || (obj.MD5 != "" && obj.MD5 != hex.EncodeToString(sum[:])) {
+		t.Errorf("Upload = %+v", obj)
+	}
+	if o, err := store.Stat(folder, "a.txt", false); err != nil || o == nil || o.ID != obj.ID || o.Size != 11 {
+		t.Errorf("Stat of the upload = %+v, %v", o, err)
+	}
+	checkContents(t, store, obj.ID, "hello world")
+
+	rc, err := store.DownloadRange(obj.ID, 6, 3)
+	if err != nil {
+		t.Fatalf("DownloadRange: %v", err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "wor" {
+		t.Errorf("DownloadRange(6, 3) = %q, want %q", b, "wor")
+	}
+
+	sub, err := store.Mkdir(folder, "sub")
+	if err != nil {
+		t.Fatalf("Mkdir of a subfolder: %v", err)
+	}
+	objects, err := store.List(folder)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	names := map[string]bool{}
+	for _, o := range objects {
+		names[o.Name] = o.Folder
+	}
+	if folder, ok := names["sub"]; len(names) != 2 || !ok || !folder || names["a.txt"] {
+		t.Errorf("List = %v, want the file a.txt and the folder sub", names)
+	}
+
+	replaced, err := store.Upload(folder, "a.txt", obj.ID, strings.NewReader("new"), mtime)
+	if err != nil {
+		t.Fatalf("Upload replacing the file: %v", err)
+	}
+	checkContents(t, store, replaced.ID, "new")
+	if _, err := store.Upload(folder, "gone.txt", obj.ID+"-gone", strings.NewReader("x"), mtime); !isNotFound(err) {
+		t.Errorf("Upload replacing a missing file = %v, want not found", err)
+	}
+
+	moved, err := store.Move(replaced.ID, folder, sub, "b.txt")
+	if err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	checkContents(t, store, moved, "new")
+	if o, err := store.Stat(folder, "a.txt", false); err != nil || o != nil {
+		t.Errorf("Stat after the move = %+v, %v; want nil", o, err)
+	}
+
+	if err := store.Delete(moved, true); err != nil {
+		t.Fatalf("Delete to the trash: %v", err)
+	}
+	if o, err := store.Stat(sub, "b.txt", false); err != nil || o != nil {
+		t.Errorf("Stat of a trashed file = %+v, %v; want nil", o, err)
+	}
+	other, err := store.Upload(sub, "c.txt", "", strings.NewReader("c"), mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(other.ID, false); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Download(other.ID); !isNotFound(err) {
+		t.Errorf("Download of a deleted file = %v, want not found", err)
+	}
+	if err := store.Delete(other.ID, false); !isNotFound(err) {
+		t.Errorf("Delete of a deleted file = %v, want not found", err)
+	}
+}
+
+func checkContents(t *testing.T, store Backend, id, want string) {
+	t.Helper()
+	rc, err := store.Download(id)
+	if err != nil {
+		t.Fatalf("Download(%s): %v", id, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil || string(b) != want {
+		t.Errorf("Download(%s) = %q, %v; want %q", id, b, err, want)
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	store, err := newLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, store)
+}
+
+func TestLocalBackendRefusesEscapingIDs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newLocalBackend(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "outside.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"../outside.txt", "a/../../outside.txt", "/outside.txt", "a//b", ""} {
+		if _, err := store.Download(id); err == nil {
+			t.Errorf("Download(%q) succeeded", id)
+		}
+		if err := store.Delete(id, false); err == nil {
+			t.Errorf("Delete(%q) succeeded", id)
+		}
+	}
+	for _, name := range []string{"..", ".", "a/b", `a\b`, ""} {
+		if _, err := store.Mkdir(rootFolderID, name); err == nil {
+			t.Errorf("Mkdir(%q) succeeded", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside.txt")); err != nil {
+		t.Errorf("file outside the store was touched: %v", err)
+	}
+}
+
+// TestRestoreOldSnapshotWithoutRevisions restores a mirrored snapshot on a
+// backend that only keeps the latest contents of a file.
+func TestRestoreOldSnapshotWithoutRevisions(t *testing.T) {
+	backends := []struct {
+		name string
+		new  func(t *testing.T) Backend
+	}{
+		{"local", func(t *testing.T) Backend {
+			store, err := newLocalBackend(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+		{"s3", func(t *testing.T) Backend { return newTestS3Backend(t, newFakeS3(t)) }},
+	}
+	tests := []struct {
+		name    string
+		change  bool
+		wantErr bool
+	}{
+		{"unchanged file", false, false},
+		{"changed file", true, true},
+	}
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				source, target := t.TempDir(), t.TempDir()
+				store := backend.new(t)
+				file := filepath.Join(source, "a.txt")
+				if err := os.WriteFile(file, []byte("version1"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				opts := backupOptions{
+					Source:       source,
+					Folder:       "backup",
+					ManifestPath: filepath.Join(t.TempDir(), "manifest.json"),
+					Snapshots:    true,
+				}
+				if _, err := runBackup(store, opts); err != nil {
+					t.Fatal(err)
+				}
+				if tt.change {
+					if err := os.WriteFile(file, []byte("version2!"), 0644); err != nil {
+						t.Fatal(err)
+					}
+					// No snapshot this time, so "latest" is still the first.
+					opts.Snapshots = false
+					if _, err := runBackup(store, opts); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				err := runRestore(store, restoreOptions{Folder: "backup", Target: target, Conflict: conflictSkip, Snapshot: "latest"})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("runRestore = %v, want error %v", err, tt.wantErr)
+				}
+				b, err := os.ReadFile(filepath.Join(target, "a.txt"))
+				if tt.wantErr {
+					if err == nil {
+						t.Errorf("restore wrote %q for a file the backend no longer has", b)
+					}
+					return
+				}
+				if string(b) != "version1" {
+					t.Errorf("restored %q, %v; want version1", b, err)
+				}
+			})
+		}
+	}
+}
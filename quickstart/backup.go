@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupOptions configures a single backup run.
+type backupOptions struct {
+	Source       string
+	Folder       string
+	ManifestPath string
+	Deletion     deletionPolicy
+	// ResumableThreshold is the file size from which uploads use the
+	// resumable protocol; zero disables resumable uploads.
+	ResumableThreshold int64
+	// Snapshots records a point-in-time index after every run and pins
+	// the uploaded revisions so older snapshots stay restorable. Backends
+	// without revisions only keep the latest contents, so restoring an
+	// older snapshot fails for the files changed since.
+	Snapshots bool
+	// Retention prunes old snapshots after recording a new one.
+	Retention retentionPolicy
+	// Crypt encrypts file contents, and optionally names, before upload.
+	// Nil uploads plaintext.
+	Crypt *crypter
+	// Storage selects mirrored files or deduplicated chunks. Chunked
+	// backups can only be restored through snapshots, so they always
+	// record one.
+	Storage storageMode
+	// Exclude lists further manifests in the source tree, belonging to
+	// other destinations of the same run, which must not be backed up.
+	Exclude []string
+	// Filter selects the files to back up. Files it leaves out are
+	// handled by the deletion policy like deleted ones.
+	Filter pathFilter
+}
+
+// backupStats counts what a backup run did.
+type backupStats struct {
+	Uploaded, Moved, Unchanged, Removed, Failed int
+}
+
+// backupRun mirrors a local directory tree into a backend folder.
+type backupRun struct {
+	store    Backend
+	opts     backupOptions
+	source   string
+	manifest *manifest
+	renames  map[string][]string // MD5 -> missing paths that may have moved
+	packs    *packWriter
+}
+
+// syncResult describes what syncFile did with a single file.
+type syncResult int
+
+const (
+	syncUnchanged syncResult = iota
+	syncUploaded
+	syncMoved
+)
+
+// runBackup walks opts.Source and uploads new or changed regular files into
+// the folder named opts.Folder in store, recreating the directory hierarchy, or
+// as deduplicated chunks in chunked storage mode. The manifest at
+// opts.ManifestPath remembers what earlier runs uploaded so unchanged files
+// are skipped, moved files are renamed remotely instead of uploaded again,
+// and files deleted locally are handled according to the deletion policy.
+// Files that fail to sync are logged and the run carries on; the returned
+// error reports how many failed so the caller can exit non-zero.
+func runBackup(store Backend, opts backupOptions) (backupStats, error) {
+	source, folderName, manifestPath := opts.Source, opts.Folder, opts.ManifestPath
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return backupStats{}, fmt.Errorf("unable to read backup source: %v", err)
+	}
+	if !info.IsDir() {
+		return backupStats{}, fmt.Errorf("backup source %s is not a directory", source)
+	}
+
+	m, err := loadManifest(manifestPath)
+	if err != nil {
+		return backupStats{}, fmt.Errorf("unable to read manifest: %v", err)
+	}
+
+	rootID, err := store.Mkdir(rootFolderID, folderName)
+	if err != nil {
+		return backupStats{}, fmt.Errorf("unable to resolve backup folder %q: %v", folderName, err)
+	}
+	if m.RootID != rootID {
+		m.reset(rootID)
+	}
+	if m.Encryption != opts.Crypt.mode() {
+		if len(m.Files) > 0 {
+			log.Printf("Encryption settings changed; uploading everything again")
+		}
+		m.reset(rootID)
+		m.Encryption = opts.Crypt.mode()
+	}
+	chunked := opts.Storage == storageChunked
+	if (m.Storage == storageChunked) != chunked {
+		if len(m.Files) > 0 {
+			log.Printf("Storage mode changed to %s; uploading everything again", opts.Storage)
+		}
+		m.reset(rootID)
+		m.Encryption = opts.Crypt.mode()
+	}
+	m.Storage = opts.Storage
+	m.Folders["."] = rootID
+	if _, ok := store.(revisionStore); !ok && opts.Snapshots && !chunked {
+		log.Printf("The backend keeps no old versions of files, so snapshots can only restore files unchanged since; use -storage chunked for point-in-time restores")
+	}
+
+	run := &backupRun{
+		store:    store,
+		opts:     opts,
+		source:   source,
+		manifest: m,
+	}
+	manifests := []string{manifestPath}
+	manifests = append(manifests, opts.Exclude...)
+
+	if chunked {
+		if err := run.prepareChunkStore(); err != nil {
+			return backupStats{}, fmt.Errorf("unable to open chunk store: %v", err)
+		}
+	}
+
+	var files []string
+	seenFiles := map[string]bool{}
+	seenDirs := map[string]bool{".": true}
+	var uploaded, moved, unchanged, failed int
+
+	err = filepath.WalkDir(source, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipping %s: %v", p, err)
+			failed++
+			return nil
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && opts.Filter.excludes(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			seenDirs[rel] = true
+			// With includes, folders are made as files need them rather
+			// than mirroring directories that end up empty.
+			if chunked || len(opts.Filter.Include) > 0 {
+				return nil
+			}
+			if _, err := run.folderID(rel); err != nil {
+				log.Printf("Unable to create folder %s: %v", rel, err)
+				failed++
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || isManifestFile(p, manifests) || !opts.Filter.includes(rel) {
+			return nil
+		}
+		files = append(files, rel)
+		seenFiles[rel] = true
+		return nil
+	})
+	if err != nil {
+		return backupStats{}, err
+	}
+
+	run.renames = missingByHash(m, seenFiles)
+	for _, rel := range files {
+		var res syncResult
+		if chunked {
+			res, err = run.syncChunked(rel)
+		} else {
+			res, err = run.syncFile(rel)
+		}
+		if err != nil {
+			log.Printf("Unable to upload %s: %v", rel, err)
+			failed++
+			continue
+		}
+		switch res {
+		case syncUploaded:
+			uploaded++
+		case syncMoved:
+			moved++
+		default:
+			unchanged++
+		}
+	}
+
+	for rel := range m.Uploads {
+		if !seenFiles[rel] {
+			delete(m.Uploads, rel)
+		}
+	}
+
+	var removed int
+	if chunked {
+		if err := run.flushPack(); err != nil {
+			log.Printf("Unable to store chunks: %v", err)
+			failed++
+		}
+		// Deleted files simply drop out of the next snapshot; their chunks
+		// go when retention prunes the last snapshot using them.
+		for rel := range m.Files {
+			if !seenFiles[rel] {
+				delete(m.Files, rel)
+				removed++
+			}
+		}
+	} else if opts.Deletion.Mode != deleteKeep {
+		// Deleting a file would take the revisions snapshots restore
+		// with it, so those files wait for retention to prune them.
+		referenced, err := snapshotFileIDs(store, opts.Crypt, rootID)
+		if err != nil {
+			log.Printf("Unable to read snapshots; keeping deleted files this run: %v", err)
+			failed++
+		} else {
+			var delFailed int
+			removed, delFailed = run.applyDeletions(opts.Deletion, seenFiles, seenDirs, referenced, time.Now())
+			failed += delFailed
+		}
+	}
+
+	if err := m.save(manifestPath); err != nil {
+		return backupStats{}, fmt.Errorf("unable to save manifest: %v", err)
+	}
+
+	if opts.Snapshots || chunked {
+		snap, err := run.recordSnapshot(time.Now())
+		if err != nil {
+			log.Printf("Unable to record snapshot: %v", err)
+			failed++
+		} else {
+			log.Printf("Recorded snapshot %s with %d files", snap.ID, len(snap.Files))
+			if opts.Retention.enabled() {
+				if err := pruneSnapshots(store, opts.Crypt, rootID, opts.Retention, manifestRevisions(m), false); err != nil {
+					log.Printf("Unable to apply retention policy: %v", err)
+					failed++
+				}
+			}
+		}
+	}
+
+	log.Printf("Backup finished: %d uploaded, %d moved, %d unchanged, %d removed, %d failed",
+		uploaded, moved, unchanged, removed, failed)
+	stats := backupStats{uploaded, moved, unchanged, removed, failed}
+	if failed > 0 {
+		return stats, fmt.Errorf("%d files failed to back up", failed)
+	}
+	return stats, nil
+}
+
+// checkpoint saves the manifest mid-run so progress survives the pod being
+// killed. Failures are only logged; the final save reports them.
+func (r *backupRun) checkpoint() {
+	if err := r.manifest.save(r.opts.ManifestPath); err != nil {
+		log.Printf("Unable to checkpoint manifest: %v", err)
+	}
+}
+
+// isManifestFile reports whether p is one of the manifests or their
+// temporary files, which must never be backed up themselves.
+func isManifestFile(p string, manifests []string) bool {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	for _, m := range manifests {
+		manifestAbs, err := filepath.Abs(m)
+		if err != nil {
+			continue
+		}
+		if abs == manifestAbs {
+			return true
+		}
+		if filepath.Dir(abs) == filepath.Dir(manifestAbs) && strings.HasPrefix(filepath.Base(abs), ".manifest-") {
+			return true
+		}
+	}
+	return false
+}
+
+// folderID returns the remote folder ID mirroring the relative directory rel,
+// creating it and any missing parents on first use.
+func (r *backupRun) folderID(rel string) (string, error) {
+	if id, ok := r.manifest.Folders[rel]; ok {
+		return id, nil
+	}
+	parentID, err := r.folderID(path.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	name, err := r.opts.Crypt.encryptName(path.Base(rel))
+	if err != nil {
+		return "", err
+	}
+	id, err := r.store.Mkdir(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	r.manifest.Folders[rel] = id
+	return id, nil
+}
+
+// syncFile brings the remote copy of the file at rel up to date with the
+// local file, reporting whether it was left alone, uploaded or moved.
+func (r *backupRun) syncFile(rel string) (syncResult, error) {
+	local := filepath.Join(r.source, filepath.FromSlash(rel))
+	info, err := os.Stat(local)
+	if err != nil {
+		return syncUnchanged, err
+	}
+
+	entry := r.manifest.Files[rel]
+	if entry != nil {
+		entry.DeletedAt = nil
+		if entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			return syncUnchanged, nil
+		}
+	}
+
+	sum, err := fileMD5(local)
+	if err != nil {
+		return syncUnchanged, err
+	}
+	if entry != nil && entry.MD5 == sum {
+		// Touched but not modified; remember the new mtime so the hash
+		// is not recomputed next run.
+		entry.Size = info.Size()
+		entry.ModTime = info.ModTime()
+		return syncUnchanged, nil
+	}
+
+	parentID, err := r.folderID(path.Dir(rel))
+	if err != nil {
+		return syncUnchanged, err
+	}
+	name, err := r.opts.Crypt.encryptName(path.Base(rel))
+	if err != nil {
+		return syncUnchanged, err
+	}
+
+	if entry == nil {
+		if oldRel, ok := r.takeRename(sum, rel); ok {
+			old := r.manifest.Files[oldRel]
+			if id, err := r.store.Move(old.FileID, old.ParentID, parentID, name); err == nil {
+				delete(r.manifest.Files, oldRel)
+				r.manifest.Files[rel] = &manifestEntry{
+					Size:       info.Size(),
+					ModTime:    info.ModTime(),
+					MD5:        sum,
+					FileID:     id,
+					ParentID:   parentID,
+					RevisionID: old.RevisionID,
+				}
+				return syncMoved, nil
+			} else if !isNotFound(err) {
+				return syncUnchanged, err
+			}
+			// The old remote copy is gone; fall through to a fresh upload.
+		}
+	}
+
+	fileID := ""
+	if entry != nil && entry.ParentID == parentID {
+		fileID = entry.FileID
+	}
+	var uploaded *object
+	if d, ok := r.store.(*driveBackend); ok && r.opts.ResumableThreshold > 0 && info.Size() >= r.opts.ResumableThreshold {
+		uploaded, err = r.resumableUpload(d, rel, local, name, parentID, fileID, sum)
+	} else {
+		uploaded, err = r.uploadFile(local, name, parentID, fileID)
+	}
+	if err != nil {
+		return syncUnchanged, err
+	}
+
+	if revs, ok := r.store.(revisionStore); ok && r.opts.Snapshots && uploaded.Revision != "" {
+		if err := revs.PinRevision(uploaded.ID, uploaded.Revision); err != nil {
+			log.Printf("Unable to pin revision of %s; older snapshots may lose it: %v", rel, err)
+		}
+	}
+
+	r.manifest.Files[rel] = &manifestEntry{
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		MD5:        sum,
+		FileID:     uploaded.ID,
+		ParentID:   parentID,
+		RevisionID: uploaded.Revision,
+	}
+	return syncUploaded, nil
+}
+
+// uploadFile sends the contents of local to the backend. When fileID is
+// known the existing file is replaced; otherwise the file is looked up by
+// name in parentID and created if missing.
+func (r *backupRun) uploadFile(local, name, parentID, fileID string) (*object, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+
+	if fileID == "" {
+		existing, err := r.store.Stat(parentID, name, false)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			fileID = existing.ID
+		}
+	}
+
+	if fileID != "" {
+		updated, err := r.sendFile(local, func(media io.Reader) (*object, error) {
+			return r.store.Upload(parentID, name, fileID, media, info.ModTime())
+		})
+		if !isNotFound(err) {
+			return updated, err
+		}
+		// The remote copy was removed behind our back; upload it afresh.
+	}
+	return r.sendFile(local, func(media io.Reader) (*object, error) {
+		return r.store.Upload(parentID, name, "", media, info.ModTime())
+	})
+}
+
+// sendFile streams the upload payload of local, encrypted if configured,
+// into upload and checks the backend stored exactly the bytes that were sent.
+func (r *backupRun) sendFile(local string, upload func(io.Reader) (*object, error)) (*object, error) {
+	var salt []byte
+	if r.opts.Crypt != nil {
+		var err error
+		if salt, err = newSalt(); err != nil {
+			return nil, err
+		}
+	}
+	payload, closer, err := r.openPayload(local, salt, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	h := md5.New()
+	uploaded, err := upload(io.TeeReader(payload, h))
+	if err != nil {
+		return nil, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); uploaded.MD5 != "" && uploaded.MD5 != sum {
+		return nil, fmt.Errorf("checksum mismatch after upload: sent %s, stored %s", sum, uploaded.MD5)
+	}
+	return uploaded, nil
+}
+
+// openPayload opens local for upload starting at byte offset of the payload.
+// With encryption on the payload is the ciphertext for the given salt.
+func (r *backupRun) openPayload(local string, salt []byte, offset int64) (io.Reader, io.Closer, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.opts.Crypt == nil {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, f, nil
+	}
+
+	enc, err := r.opts.Crypt.newEncryptReader(f, salt)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	// The ciphertext is deterministic for a salt, so skipping ahead just
+	// means re-encrypting and discarding the part already uploaded.
+	if _, err := io.CopyN(io.Discard, enc, offset); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return enc, f, nil
+}
+
+// payloadSize is the number of bytes uploaded for a local file of size n.
+func (r *backupRun) payloadSize(n int64) int64 {
+	if r.opts.Crypt == nil {
+		return n
+	}
+	return encryptedSize(n)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// In chunked storage mode files are split with content-defined chunking and
+// each distinct chunk is stored once, packed together with other new chunks
+// into pack files in chunksFolderName. Files are only described by the list
+// of chunk IDs in the manifest and the per-run snapshot index, so a large
+// file with a small edit only uploads the few chunks around the edit.
+const (
+	chunksFolderName = ".drive-backup-chunks"
+
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 4 << 20
+	// chunkBits sets the average chunk size to roughly 1 MiB.
+	chunkBits = 20
+	// packTargetSize is the size at which a pack file is uploaded.
+	packTargetSize = 16 << 20
+)
+
+// storageMode selects how file contents are laid out in Drive.
+type storageMode string
+
+const (
+	// storageFiles mirrors every local file as a Drive file.
+	storageFiles storageMode = "files"
+	// storageChunked stores deduplicated chunks in pack files.
+	storageChunked storageMode = "chunked"
+)
+
+func parseStorageMode(s string) (storageMode, error) {
+	switch storageMode(s) {
+	case storageFiles, storageChunked:
+		return storageMode(s), nil
+	}
+	return "", fmt.Errorf("unknown storage mode %q (want files or chunked)", s)
+}
+
+// chunkLocation is where a chunk's (possibly encrypted) bytes live.
+type chunkLocation struct {
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// gearTable drives the rolling hash. It is generated from a fixed seed so
+// chunk boundaries, and therefore deduplication, are stable across builds.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunker splits a stream at content-defined boundaries using a gear hash,
+// so inserting or removing bytes only changes the chunks around the edit.
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, 1<<20), buf: make([]byte, 0, chunkMaxSize)}
+}
+
+// next returns the next chunk, valid until the following call, or io.EOF.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var fp uint64
+	for len(c.buf) < chunkMaxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		fp = (fp << 1) + gearTable[b]
+		if len(c.buf) >= chunkMinSize && fp>>(64-chunkBits) == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// chunkID names a chunk by its content. With encryption on it is a keyed
+// hash so chunk names do not reveal the plaintext hashes.
+func chunkID(c *crypter, data []byte) string {
+	if c == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, deriveKey(c.contentKey, "chunk id"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// packWriter collects new chunks until there is enough for a pack file.
+type packWriter struct {
+	folderID string
+	buf      bytes.Buffer
+	pending  []string
+}
+
+// prepareChunkStore resolves the pack folder and drops cached chunk
+// locations whose pack no longer exists, e.g. after a prune, together with
+// the manifest entries that depend on them.
+func (r *backupRun) prepareChunkStore() error {
+	folderID, err := r.store.Mkdir(r.manifest.RootID, chunksFolderName)
+	if err != nil {
+		return err
+	}
+	r.packs = &packWriter{folderID: folderID}
+
+	objects, err := r.store.List(folderID)
+	if err != nil {
+		return err
+	}
+	packs := map[string]bool{}
+	for _, o := range objects {
+		packs[o.ID] = true
+	}
+
+	for id, loc := range r.manifest.Chunks {
+		if !packs[loc.Pack] {
+			delete(r.manifest.Chunks, id)
+		}
+	}
+	r.dropIncompleteFiles()
+	return nil
+}
+
+// dropIncompleteFiles forgets manifest entries that reference chunks not
+// safely stored in a pack, so the next run chunks them again.
+func (r *backupRun) dropIncompleteFiles() {
+	for rel, entry := range r.manifest.Files {
+		for _, id := range entry.Chunks {
+			if loc, ok := r.manifest.Chunks[id]; !ok || loc.Pack == "" {
+				delete(r.manifest.Files, rel)
+				break
+			}
+		}
+	}
+}
+
+// syncChunked stores the file at rel as a list of deduplicated chunks.
+func (r *backupRun) syncChunked(rel string) (syncResult, error) {
+	local := filepath.Join(r.source, filepath.FromSlash(rel))
+	f, err := os.Open(local)
+	if err != nil {
+		return syncUnchanged, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return syncUnchanged, err
+	}
+	entry := r.manifest.Files[rel]
+	if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return syncUnchanged, nil
+	}
+
+	h := md5.New()
+	c := newChunker(io.TeeReader(f, h))
+	var ids []string
+	var stored int
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return syncUnchanged, err
+		}
+		id := chunkID(r.opts.Crypt, data)
+		ids = append(ids, id)
+		if _, ok := r.manifest.Chunks[id]; ok {
+			continue
+		}
+		if err := r.addChunk(id, data); err != nil {
+			return syncUnchanged, err
+		}
+		stored++
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	r.manifest.Files[rel] = &manifestEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		MD5:     sum,
+		Chunks:  ids,
+	}
+	if entry != nil && entry.MD5 == sum {
+		return syncUnchanged, nil
+	}
+	if stored == 0 && len(ids) > 0 {
+		log.Printf("%s: all %d chunks already stored", rel, len(ids))
+	}
+	return syncUploaded, nil
+}
+
+// addChunk appends a new chunk, sealed if encryption is on, to the current
+// pack and uploads the pack once it is large enough.
+func (r *backupRun) addChunk(id string, data []byte) error {
+	sealed, err := r.opts.Crypt.sealBytes(data)
+	if err != nil {
+		return err
+	}
+	p := r.packs
+	r.manifest.Chunks[id] = chunkLocation{Offset: int64(p.buf.Len()), Length: int64(len(sealed))}
+	p.buf.Write(sealed)
+	p.pending = append(p.pending, id)
+	if p.buf.Len() >= packTargetSize {
+		return r.flushPack()
+	}
+	return nil
+}
+
+// flushPack uploads the pending chunks as one pack file and records its ID
+// in their locations.
+func (r *backupRun) flushPack() error {
+	p := r.packs
+	if p == nil || len(p.pending) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(p.buf.Bytes())
+	f, err := r.store.Upload(p.folderID, hex.EncodeToString(sum[:])+".pack", "", bytes.NewReader(p.buf.Bytes()), time.Now())
+	if err != nil {
+		for _, id := range p.pending {
+			delete(r.manifest.Chunks, id)
+		}
+	} else {
+		for _, id := range p.pending {
+			loc := r.manifest.Chunks[id]
+			loc.Pack = f.ID
+			r.manifest.Chunks[id] = loc
+		}
+	}
+	p.buf.Reset()
+	p.pending = nil
+	if err != nil {
+		r.dropIncompleteFiles()
+		return fmt.Errorf("unable to upload pack: %v", err)
+	}
+	return nil
+}
+
+// readChunk fetches one chunk from its pack with a ranged download and
+// checks it against its ID.
+func readChunk(store Backend, c *crypter, id string, loc chunkLocation) ([]byte, error) {
+	rc, err := store.DownloadRange(loc.Pack, loc.Offset, loc.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	sealed, err := io.ReadAll(io.LimitReader(rc, loc.Length))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.openReader(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(plain)
+	if err != nil {
+		return nil, err
+	}
+	if chunkID(c, data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt", id)
+	}
+	return data, nil
+}
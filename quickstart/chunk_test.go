@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// randomData returns n pseudo-random bytes that are the same on every run.
+func randomData(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// chunkSums splits data and returns the hash of every chunk in order.
+func chunkSums(t *testing.T, data []byte) [][32]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data))
+	var sums [][32]byte
+	var total int
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(chunk)
+		sums = append(sums, sha256.Sum256(chunk))
+	}
+	if total != len(data) {
+		t.Fatalf("chunks add up to %d bytes, want %d", total, len(data))
+	}
+	return sums
+}
+
+func TestGearTableIsFixed(t *testing.T) {
+	// Changing the table moves every chunk boundary, so existing chunked
+	// backups would no longer deduplicate against new runs.
+	if gearTable[0] != 0x6e789e6aa1b965f4 || gearTable[255] != 0xcbdc6d34b7c7534d {
+		t.Errorf("gear table changed: %#x ... %#x", gearTable[0], gearTable[255])
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"small", randomData(1, 1000)},
+		{"random", randomData(2, 12<<20)},
+		// Zeros never hit a boundary, so chunks are cut at the maximum.
+		{"zeros", make([]byte, 9<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newChunker(bytes.NewReader(tt.data))
+			var joined []byte
+			for {
+				chunk, err := c.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				last := len(joined)+len(chunk) == len(tt.data)
+				if len(chunk) > chunkMaxSize || (!last && len(chunk) < chunkMinSize) {
+					t.Errorf("chunk of %d bytes, want %d to %d", len(chunk), chunkMinSize, chunkMaxSize)
+				}
+				joined = append(joined, chunk...)
+			}
+			if !bytes.Equal(joined, tt.data) {
+				t.Error("chunks do not reassemble the input")
+			}
+		})
+	}
+}
+
+func TestChunkerStableAcrossEdits(t *testing.T) {
+	base := randomData(3, 12<<20)
+	baseSums := chunkSums(t, base)
+	if len(baseSums) < 6 {
+		t.Fatalf("only %d chunks; the test needs more", len(baseSums))
+	}
+	known := map[[32]byte]bool{}
+	for _, s := range baseSums {
+		known[s] = true
+	}
+
+	edit := func(at int, insert []byte, remove int) []byte {
+		out := append([]byte(nil), base[:at]...)
+		out = append(out, insert...)
+		return append(out, base[at+remove:]...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"insert a byte at the start", edit(0, []byte{1}, 0)},
+		{"insert a byte in the middle", edit(len(base)/2, []byte{1}, 0)},
+		{"insert 100 bytes in the middle", edit(len(base)/2, randomData(4, 100), 0)},
+		{"insert near the end", edit(len(base)-10, []byte("tail"), 0)},
+		{"remove bytes in the middle", edit(len(base)/3, nil, 4096)},
+		{"overwrite in the middle", edit(len(base)/2, randomData(5, 50), 50)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changed int
+			for _, s := range chunkSums(t, tt.data) {
+				if !known[s] {
+					changed++
+				}
+			}
+			// The chunk holding the edit changes, and at most the next one
+			// before the boundaries line up again.
+			if changed > 2 {
+				t.Errorf("%d of %d chunks changed, want at most 2", changed, len(baseSums))
+			}
+		})
+	}
+}
+
+func TestChunkID(t *testing.T) {
+	data := []byte("chunk")
+	key := testCrypter(t)
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"plain is stable", chunkID(nil, data), chunkID(nil, data), true},
+		{"keyed is stable", chunkID(key, data), chunkID(key, data), true},
+		{"keyed hides the plain hash", chunkID(key, data), chunkID(nil, data), false},
+		{"content matters", chunkID(nil, data), chunkID(nil, []byte("other")), false},
+	}
+	for _, tt := range tests {
+		if (tt.a == tt.b) != tt.same {
+			t.Errorf("%s: %s vs %s", tt.name, tt.a, tt.b)
+		}
+	}
+}
+
+func TestChunkedBackupRoundTrip(t *testing.T) {
+	for _, c := range []*crypter{nil, testCrypter(t)} {
+		source, remote, target := t.TempDir(), t.TempDir(), t.TempDir()
+		files := map[string][]byte{
+			"big.bin":       randomData(6, 5<<20),
+			"dir/copy.bin":  randomData(6, 5<<20),
+			"dir/small.txt": []byte("small"),
+			"empty":         nil,
+		}
+		for rel, data := range files {
+			p := filepath.Join(source, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store, err := newLocalBackend(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := backupOptions{
+			Source:       source,
+			Folder:       "backup",
+			ManifestPath: filepath.Join(t.TempDir(), "manifest.json"),
+			Storage:      storageChunked,
+			Crypt:        c,
+		}
+		if _, err := runBackup(store, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		// The copy deduplicates against big.bin, so the packs hold about
+		// one copy of it.
+		var stored int64
+		filepath.Walk(filepath.Join(remote, "backup", chunksFolderName), func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				stored += info.Size()
+			}
+			return nil
+		})
+		if stored > 6<<20 {
+			t.Errorf("packs hold %d bytes for 5 MiB of distinct data", stored)
+		}
+
+		if err := runRestore(store, restoreOptions{Folder: "backup", Target: target, Conflict: conflictSkip, Crypt: c}); err != nil {
+			t.Fatal(err)
+		}
+		for rel, want := range files {
+			got, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(rel)))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("encrypted %v: restored %s differs (%v)", c != nil, rel, err)
+			}
+		}
+	}
+}
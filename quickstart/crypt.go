@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files are a header followed by a sequence of AES-256-GCM sealed
+// chunks. Each file gets its own key derived from a random salt, and chunk
+// nonces are the chunk counter plus a final-chunk flag, so chunks cannot be
+// reordered, dropped or truncated without decryption failing.
+//
+//	header: "DBK1" | salt (16 bytes)
+//	chunk:  AES-GCM(fileKey, nonce = counter (11 bytes) | last (1 byte), up to 64 KiB)
+const (
+	cryptMagic     = "DBK1"
+	cryptSaltSize  = 16
+	cryptChunkSize = 64 << 10
+	cryptHeaderLen = len(cryptMagic) + cryptSaltSize
+)
+
+var errNotEncrypted = errors.New("data is not encrypted")
+
+// crypter holds the keys for client-side encryption. A nil *crypter means
+// encryption is off; its methods then pass data and names through.
+type crypter struct {
+	contentKey   []byte
+	nameKey      []byte
+	encryptNames bool
+	// allowPlaintext accepts data without the encryption header, for
+	// reading what was backed up before encryption was turned on.
+	allowPlaintext bool
+}
+
+// loadCrypter reads a 32-byte master key from path, given as raw bytes, hex
+// or base64, and derives separate content and name keys from it.
+func loadCrypter(path string, encryptNames bool) (*crypter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", path, err)
+	}
+	return &crypter{
+		contentKey:   deriveKey(key, "content"),
+		nameKey:      deriveKey(key, "names"),
+		encryptNames: encryptNames,
+	}, nil
+}
+
+func parseKey(b []byte) ([]byte, error) {
+	if len(b) == 32 {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	if k, err := hex.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, errors.New("want 32 bytes, raw, hex or base64 encoded")
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("drive-backup " + purpose))
+	return mac.Sum(nil)
+}
+
+// mode describes the encryption settings, recorded in the manifest so a
+// change forces everything to be uploaded again.
+func (c *crypter) mode() string {
+	switch {
+	case c == nil:
+		return ""
+	case c.encryptNames:
+		return "content+names"
+	}
+	return "content"
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptName deterministically encrypts a single path element, so the
+// same local name always maps to the same Drive name and lookups by name
+// keep working.
+func (c *crypter) encryptName(name string) (string, error) {
+	if c == nil || !c.encryptNames {
+		return name, nil
+	}
+	aead, err := newGCM(c.nameKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := c.nameNonce(name, aead.NonceSize())
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(name), nil)), nil
+}
+
+// nameNonce derives the synthetic nonce encryptName uses for name.
+func (c *crypter) nameNonce(name string, size int) []byte {
+	mac := hmac.New(sha256.New, c.nameKey)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:size]
+}
+
+// decryptName reverses encryptName. The nonce is derived from the name, so
+// a name sealed under any other nonce was not written by encryptName and
+// is rejected.
+func (c *crypter) decryptName(s string) (string, error) {
+	if c == nil || !c.encryptNames {
+		return s, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(c.nameKey)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("encrypted name too short")
+	}
+	nonce := b[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(nonce, c.nameNonce(string(plain), len(nonce))) != 1 {
+		return "", errors.New("encrypted name does not match its nonce")
+	}
+	return string(plain), nil
+}
+
+// newSalt returns a fresh random per-file salt.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, cryptSaltSize)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// encryptedSize returns the size of the encrypted form of n plaintext bytes.
+func encryptedSize(n int64) int64 {
+	chunks := (n + cryptChunkSize - 1) / cryptChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(cryptHeaderLen) + n + chunks*16
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader streams the encrypted form of a plaintext reader.
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	buf     bytes.Buffer
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+// newEncryptReader encrypts src with a key derived from salt. Using the
+// same salt again yields identical output, which is what lets resumable
+// uploads continue part way through a file.
+func (c *crypter) newEncryptReader(src io.Reader, salt []byte) (io.Reader, error) {
+	aead, err := newGCM(fileKey(c.contentKey, salt))
+	if err != nil {
+		return nil, err
+	}
+	r := &encryptReader{src: src, aead: aead, plain: make([]byte, cryptChunkSize+1)}
+	r.buf.WriteString(cryptMagic)
+	r.buf.Write(salt)
+	return r, nil
+}
+
+func fileKey(contentKey, salt []byte) []byte {
+	mac := hmac.New(sha256.New, contentKey)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// sealNext encrypts the next chunk. It reads one byte beyond the chunk size
+// to learn whether this is the final chunk; that byte starts the next one.
+func (r *encryptReader) sealNext() error {
+	carry := 0
+	if r.counter > 0 {
+		carry = 1
+	}
+	n, err := io.ReadFull(r.src, r.plain[carry:])
+	n += carry
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+
+	size := n
+	if !last {
+		size = cryptChunkSize
+	}
+	r.buf.Write(r.aead.Seal(nil, chunkNonce(r.counter, last), r.plain[:size], nil))
+	r.counter++
+	if last {
+		r.done = true
+	} else {
+		r.plain[0] = r.plain[cryptChunkSize]
+	}
+	return nil
+}
+
+// decryptReader streams the plaintext of an encrypted reader.
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	buf     bytes.Buffer
+	sealed  []byte
+	counter uint64
+	done    bool
+}
+
+// newDecryptReader reads the header from src and returns a reader of the
+// plaintext. If src does not start with the header, errNotEncrypted is
+// returned together with a reader replaying everything read so far.
+func (c *crypter) newDecryptReader(src io.Reader) (io.Reader, error) {
+	header := make([]byte, cryptHeaderLen)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n < cryptHeaderLen || string(header[:len(cryptMagic)]) != cryptMagic {
+		return io.MultiReader(bytes.NewReader(header[:n]), src), errNotEncrypted
+	}
+	aead, err := newGCM(fileKey(c.contentKey, header[len(cryptMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	overhead := aead.Overhead()
+	return &decryptReader{
+		src:    src,
+		aead:   aead,
+		sealed: make([]byte, cryptChunkSize+overhead+1),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *decryptReader) openNext() error {
+	full := cryptChunkSize + r.aead.Overhead()
+	carry := 0
+	if r.counter > 0 {
+		carry = 1
+	}
+	n, err := io.ReadFull(r.src, r.sealed[carry:])
+	n += carry
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+
+	size := n
+	if !last {
+		size = full
+	}
+	plain, err := r.aead.Open(nil, chunkNonce(r.counter, last), r.sealed[:size], nil)
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: %v", r.counter, err)
+	}
+	r.buf.Write(plain)
+	r.counter++
+	if last {
+		r.done = true
+	} else {
+		r.sealed[0] = r.sealed[full]
+	}
+	return nil
+}
+
+// sealBytes encrypts a small in-memory blob such as a snapshot index.
+func (c *crypter) sealBytes(b []byte) ([]byte, error) {
+	if c == nil {
+		return b, nil
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.newEncryptReader(bytes.NewReader(b), salt)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// openReader returns a reader of the plaintext of src. Data without the
+// encryption header is refused unless allowPlaintext is set: anyone able to
+// write to the remote could otherwise swap in unauthenticated plaintext.
+func (c *crypter) openReader(src io.Reader) (io.Reader, error) {
+	if c == nil {
+		return src, nil
+	}
+	r, err := c.newDecryptReader(src)
+	if err == errNotEncrypted {
+		if c.allowPlaintext {
+			return r, nil
+		}
+		return nil, fmt.Errorf("%w; -allow-plaintext reads data backed up before encryption was turned on", err)
+	}
+	return r, err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testCrypter(t *testing.T) *crypter {
+	t.Helper()
+	key := bytes.Repeat([]byte{7}, 32)
+	return &crypter{contentKey: deriveKey(key, "content"), nameKey: deriveKey(key, "names"), encryptNames: true}
+}
+
+func seal(t *testing.T, c *crypter, plain []byte) []byte {
+	t.Helper()
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.newEncryptReader(bytes.NewReader(plain), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func open(c *crypter, sealed []byte) ([]byte, error) {
+	r, err := c.openReader(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	c := testCrypter(t)
+	for _, n := range []int{0, 1, 100, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 2 * cryptChunkSize, 3*cryptChunkSize + 5} {
+		plain := make([]byte, n)
+		rand.Read(plain)
+		sealed := seal(t, c, plain)
+		if int64(len(sealed)) != encryptedSize(int64(n)) {
+			t.Errorf("%d bytes: sealed to %d bytes, encryptedSize says %d", n, len(sealed), encryptedSize(int64(n)))
+		}
+		got, err := open(c, sealed)
+		if err != nil {
+			t.Errorf("%d bytes: open: %v", n, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: round trip changed the data", n)
+		}
+	}
+}
+
+func TestCryptSameSaltIsDeterministic(t *testing.T) {
+	c := testCrypter(t)
+	plain := bytes.Repeat([]byte("abc"), cryptChunkSize)
+	salt := bytes.Repeat([]byte{1}, cryptSaltSize)
+	var out [2][]byte
+	for i := range out {
+		r, err := c.newEncryptReader(bytes.NewReader(plain), salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out[i], err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(out[0], out[1]) {
+		t.Error("the same salt gave different ciphertexts, so uploads cannot resume")
+	}
+}
+
+func TestCryptRejectsTampering(t *testing.T) {
+	c := testCrypter(t)
+	plain := make([]byte, 2*cryptChunkSize+10)
+	rand.Read(plain)
+	sealed := seal(t, c, plain)
+	sealedChunk := cryptChunkSize + 16
+	firstChunkEnd := cryptHeaderLen + sealedChunk
+	secondChunkEnd := firstChunkEnd + sealedChunk
+
+	swapped := append([]byte(nil), sealed[:cryptHeaderLen]...)
+	swapped = append(swapped, sealed[firstChunkEnd:secondChunkEnd]...)
+	swapped = append(swapped, sealed[cryptHeaderLen:firstChunkEnd]...)
+	swapped = append(swapped, sealed[secondChunkEnd:]...)
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[cryptHeaderLen+10] ^= 1
+
+	otherKey := &crypter{contentKey: deriveKey(bytes.Repeat([]byte{8}, 32), "content")}
+
+	tests := []struct {
+		name   string
+		c      *crypter
+		sealed []byte
+	}{
+		{"header only", c, sealed[:cryptHeaderLen]},
+		{"truncated mid-chunk", c, sealed[:cryptHeaderLen+100]},
+		{"truncated at a chunk boundary", c, sealed[:firstChunkEnd]},
+		{"last chunk dropped", c, sealed[:secondChunkEnd]},
+		{"last byte dropped", c, sealed[:len(sealed)-1]},
+		{"chunks reordered", c, swapped},
+		{"bit flipped", c, flipped},
+		{"wrong key", otherKey, sealed},
+	}
+	for _, tt := range tests {
+		if got, err := open(tt.c, tt.sealed); err == nil {
+			t.Errorf("%s: opened to %d bytes, want an error", tt.name, len(got))
+		}
+	}
+}
+
+func TestOpenReaderPlaintext(t *testing.T) {
+	plain := []byte(`{"files":{"../../etc/x":{}}}`)
+	tests := []struct {
+		name    string
+		c       *crypter
+		wantErr bool
+	}{
+		{"no key", nil, false},
+		{"key", testCrypter(t), true},
+		{"key allowing plaintext", &crypter{contentKey: testCrypter(t).contentKey, allowPlaintext: true}, false},
+	}
+	for _, tt := range tests {
+		got, err := open(tt.c, plain)
+		if tt.wantErr {
+			if !errors.Is(err, errNotEncrypted) {
+				t.Errorf("%s: open = %q, %v; want errNotEncrypted", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: open = %q, %v; want the plaintext", tt.name, got, err)
+		}
+	}
+}
+
+func TestSealBytes(t *testing.T) {
+	c := testCrypter(t)
+	plain := []byte("snapshot index")
+	sealed, err := c.sealBytes(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Error("sealed blob contains the plaintext")
+	}
+	if got, err := open(c, sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("open = %q, %v", got, err)
+	}
+	var off *crypter
+	if got, err := off.sealBytes(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("nil crypter sealBytes = %q, %v; want the input", got, err)
+	}
+}
+
+func TestEncryptName(t *testing.T) {
+	c := testCrypter(t)
+	for _, name := range []string{"a", "file.txt", "with space", strings.Repeat("x", 200), "ünïcødé"} {
+		enc, err := c.encryptName(name)
+		if err != nil || enc == name || strings.ContainsAny(enc, `/\`) {
+			t.Errorf("encryptName(%q) = %q, %v", name, enc, err)
+		}
+		if again, _ := c.encryptName(name); again != enc {
+			t.Errorf("encryptName(%q) not deterministic: %q, %q", name, enc, again)
+		}
+		if got, err := c.decryptName(enc); err != nil || got != name {
+			t.Errorf("decryptName(encryptName(%q)) = %q, %v", name, got, err)
+		}
+	}
+	if _, err := c.decryptName("not-encrypted"); err == nil {
+		t.Error("decryptName of a plain name succeeded")
+	}
+
+	// A name sealed with the name key under a nonce encryptName would not
+	// have chosen, say a swapped-in name, is rejected.
+	aead, err := newGCM(c.nameKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, _ := base64.RawURLEncoding.DecodeString(mustEncryptName(t, c, "other.txt"))
+	nonce = nonce[:aead.NonceSize()]
+	forged := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("file.txt"), nil))
+	if got, err := c.decryptName(forged); err == nil {
+		t.Errorf("decryptName of a name under another nonce = %q", got)
+	}
+
+	plainNames := &crypter{contentKey: c.contentKey, nameKey: c.nameKey}
+	if got, err := plainNames.encryptName("a.txt"); err != nil || got != "a.txt" {
+		t.Errorf("encryptName without encryptNames = %q, %v", got, err)
+	}
+}
+
+func mustEncryptName(t *testing.T, c *crypter, name string) string {
+	t.Helper()
+	enc, err := c.encryptName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func TestParseKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xab}, 32)
+	tests := []struct {
+		name string
+		in   []byte
+		ok   bool
+	}{
+		{"raw", raw, true},
+		{"hex", []byte(hex.EncodeToString(raw) + "\n"), true},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(raw)), true},
+		{"short", raw[:31], false},
+		{"short hex", []byte(hex.EncodeToString(raw[:20])), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		key, err := parseKey(tt.in)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: parseKey error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && !bytes.Equal(key, raw) {
+			t.Errorf("%s: parseKey = %x", tt.name, key)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deletionMode says what happens to the Drive copy of a file that no longer
+// exists in the backup source.
+type deletionMode string
+
+const (
+	// deleteKeep leaves the Drive copy untouched forever.
+	deleteKeep deletionMode = "keep"
+	// deleteTrash moves the Drive copy to the Drive trash straight away.
+	deleteTrash deletionMode = "trash"
+	// deleteAfter permanently deletes the Drive copy once the file has
+	// been missing locally for the configured grace period.
+	deleteAfter deletionMode = "delete-after"
+)
+
+type deletionPolicy struct {
+	Mode  deletionMode
+	Grace time.Duration
+}
+
+// parseDeletionPolicy validates the -deletion and -delete-after-days flags.
+func parseDeletionPolicy(mode string, days int) (deletionPolicy, error) {
+	switch deletionMode(mode) {
+	case deleteKeep, deleteTrash:
+		return deletionPolicy{Mode: deletionMode(mode)}, nil
+	case deleteAfter:
+		if days < 0 {
+			return deletionPolicy{}, fmt.Errorf("delete-after days must not be negative, got %d", days)
+		}
+		return deletionPolicy{Mode: deleteAfter, Grace: time.Duration(days) * 24 * time.Hour}, nil
+	}
+	return deletionPolicy{}, fmt.Errorf("unknown deletion mode %q (want keep, trash or delete-after)", mode)
+}
+
+// heldBySnapshots explains, for the run's log, that the policy cannot
+// remove anything a snapshot still refers to when no retention policy ever
+// prunes snapshots; it returns "" when the policy can take effect.
+func (p deletionPolicy) heldBySnapshots(snapshots bool, retention retentionPolicy) string {
+	if p.Mode == deleteKeep || !snapshots || retention.enabled() {
+		return ""
+	}
+	return fmt.Sprintf("Deletion policy %s only removes files no snapshot refers to, and without a -keep-* retention policy "+
+		"snapshots are never pruned; deleted files stay on the backend until their snapshots are pruned", p.Mode)
+}
+
+// missingByHash indexes the manifest entries whose local file is gone by
+// content hash, so a new file with the same contents can be treated as a
+// rename rather than a fresh upload.
+func missingByHash(m *manifest, seen map[string]bool) map[string][]string {
+	var missing []string
+	for rel := range m.Files {
+		if !seen[rel] {
+			missing = append(missing, rel)
+		}
+	}
+	sort.Strings(missing)
+
+	byHash := map[string][]string{}
+	for _, rel := range missing {
+		entry := m.Files[rel]
+		if entry.FileID != "" && entry.MD5 != "" {
+			byHash[entry.MD5] = append(byHash[entry.MD5], rel)
+		}
+	}
+	return byHash
+}
+
+// takeRename pops a missing path with the given hash, preferring one with
+// the same base name so that renaming a directory maps files one to one.
+func (r *backupRun) takeRename(sum, rel string) (string, bool) {
+	candidates := r.renames[sum]
+	if len(candidates) == 0 {
+		return "", false
+	}
+	pick := 0
+	for i, c := range candidates {
+		if path.Base(c) == path.Base(rel) {
+			pick = i
+			break
+		}
+	}
+	old := candidates[pick]
+	r.renames[sum] = append(candidates[:pick], candidates[pick+1:]...)
+	return old, true
+}
+
+// applyDeletions enforces the deletion policy for files and folders that
+// are in the manifest but were not seen locally during this run. Files in
+// referenced, the remote files snapshots still restore, are kept until
+// retention has pruned the last such snapshot. It returns the number of
+// Drive items removed and the number of failures.
+func (r *backupRun) applyDeletions(policy deletionPolicy, seenFiles, seenDirs, referenced map[string]bool, now time.Time) (removed, failed int) {
+	if policy.Mode == deleteKeep {
+		return 0, 0
+	}
+
+	var missing []string
+	for rel := range r.manifest.Files {
+		if !seenFiles[rel] {
+			missing = append(missing, rel)
+		}
+	}
+	sort.Strings(missing)
+
+	var held int
+	for _, rel := range missing {
+		entry := r.manifest.Files[rel]
+		if entry.DeletedAt == nil {
+			t := now
+			entry.DeletedAt = &t
+			if policy.Mode == deleteAfter {
+				log.Printf("%s is missing locally; deleting from Drive after %s", rel, policy.Grace)
+			}
+		}
+		if policy.Mode == deleteAfter && now.Sub(*entry.DeletedAt) < policy.Grace {
+			continue
+		}
+		if referenced[entry.FileID] {
+			held++
+			continue
+		}
+		if err := r.removeDriveItem(entry.FileID, policy); err != nil {
+			log.Printf("Unable to remove %s from Drive: %v", rel, err)
+			failed++
+			continue
+		}
+		delete(r.manifest.Files, rel)
+		removed++
+	}
+	if held > 0 {
+		log.Printf("Keeping %d deleted files on Drive until no snapshot refers to them", held)
+	}
+
+	// Folders go once nothing tracked is left beneath them. Deepest first,
+	// so a parent is never removed before its children.
+	var dirs []string
+	for rel := range r.manifest.Folders {
+		if rel != "." && !seenDirs[rel] {
+			dirs = append(dirs, rel)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+
+	for _, rel := range dirs {
+		if r.hasTrackedBelow(rel) {
+			continue
+		}
+		if err := r.removeDriveItem(r.manifest.Folders[rel], policy); err != nil {
+			log.Printf("Unable to remove folder %s from Drive: %v", rel, err)
+			failed++
+			continue
+		}
+		delete(r.manifest.Folders, rel)
+		removed++
+	}
+	return removed, failed
+}
+
+// hasTrackedBelow reports whether any manifest entry still lives under dir.
+func (r *backupRun) hasTrackedBelow(dir string) bool {
+	prefix := dir + "/"
+	for rel := range r.manifest.Files {
+		if strings.HasPrefix(rel, prefix) {
+			return true
+		}
+	}
+	for rel := range r.manifest.Folders {
+		if strings.HasPrefix(rel, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDriveItem trashes or permanently deletes a remote file or folder
+// according to policy. Items that are already gone count as removed.
+func (r *backupRun) removeDriveItem(id string, policy deletionPolicy) error {
+	err := r.store.Delete(id, policy.Mode == deleteTrash)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
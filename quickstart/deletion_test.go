@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyDeletions(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		policy     deletionPolicy
+		referenced bool
+		deletedAt  *time.Time
+		wantGone   bool
+	}{
+		{"keep", deletionPolicy{Mode: deleteKeep}, false, nil, false},
+		{"trash", deletionPolicy{Mode: deleteTrash}, false, nil, true},
+		{"trash referenced", deletionPolicy{Mode: deleteTrash}, true, nil, false},
+		{"delete-after in grace", deletionPolicy{Mode: deleteAfter, Grace: 24 * time.Hour}, false, nil, false},
+		{"delete-after expired", deletionPolicy{Mode: deleteAfter, Grace: 24 * time.Hour}, false, timePtr(now.Add(-48 * time.Hour)), true},
+		{"delete-after referenced", deletionPolicy{Mode: deleteAfter}, true, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := newLocalBackend(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj, err := store.Upload(rootFolderID, "a.txt", "", strings.NewReader("a"), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := newManifest()
+			m.Folders["."] = rootFolderID
+			m.Files["a.txt"] = &manifestEntry{FileID: obj.ID, ParentID: rootFolderID, MD5: obj.MD5, DeletedAt: tt.deletedAt}
+			run := &backupRun{store: store, manifest: m}
+
+			referenced := map[string]bool{}
+			if tt.referenced {
+				referenced[obj.ID] = true
+			}
+			removed, failed := run.applyDeletions(tt.policy, map[string]bool{}, map[string]bool{".": true}, referenced, now)
+			if failed != 0 {
+				t.Fatalf("failed = %d", failed)
+			}
+
+			_, statErr := os.Stat(filepath.Join(dir, "a.txt"))
+			if gone := os.IsNotExist(statErr); gone != tt.wantGone {
+				t.Errorf("remote file gone = %v, want %v", gone, tt.wantGone)
+			}
+			entry := m.Files["a.txt"]
+			if tt.wantGone {
+				if removed != 1 || entry != nil {
+					t.Errorf("removed = %d, entry = %v; want the entry dropped", removed, entry)
+				}
+				return
+			}
+			if removed != 0 || entry == nil {
+				t.Fatalf("removed = %d, entry = %v; want the entry kept", removed, entry)
+			}
+			if tt.policy.Mode != deleteKeep && entry.DeletedAt == nil {
+				t.Error("DeletedAt not set on a kept entry, so the next snapshot would still list it")
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestBackupKeepsFilesSnapshotsReferTo(t *testing.T) {
+	source, remote := t.TempDir(), t.TempDir()
+	store, err := newLocalBackend(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := backupOptions{
+		Source:       source,
+		Folder:       "backup",
+		ManifestPath: filepath.Join(t.TempDir(), "manifest.json"),
+		Deletion:     deletionPolicy{Mode: deleteTrash},
+		Snapshots:    true,
+	}
+	if _, err := runBackup(store, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(source, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := runBackup(store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 0 {
+		t.Errorf("removed %d files a snapshot refers to", stats.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "backup", "a.txt")); err != nil {
+		t.Errorf("remote copy of a snapshotted file is gone: %v", err)
+	}
+}
+
+func TestDeletionHeldBySnapshots(t *testing.T) {
+	trash := deletionPolicy{Mode: deleteTrash}
+	tests := []struct {
+		name      string
+		policy    deletionPolicy
+		snapshots bool
+		retention retentionPolicy
+		warn      bool
+	}{
+		{"keep", deletionPolicy{Mode: deleteKeep}, true, retentionPolicy{}, false},
+		{"trash without retention", trash, true, retentionPolicy{}, true},
+		{"delete-after without retention", deletionPolicy{Mode: deleteAfter, Grace: time.Hour}, true, retentionPolicy{}, true},
+		{"trash with retention", trash, true, retentionPolicy{Daily: 7}, false},
+		{"trash without snapshots", trash, false, retentionPolicy{}, false},
+	}
+	for _, tt := range tests {
+		msg := tt.policy.heldBySnapshots(tt.snapshots, tt.retention)
+		if (msg != "") != tt.warn {
+			t.Errorf("%s: message %q, want one: %v", tt.name, msg, tt.warn)
+		}
+	}
+}
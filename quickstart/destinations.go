@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"backupjob"
+)
+
+// destination is one place a fan-out backup run writes to. Each has its own
+// backend, credentials and folder, and its own manifest, since the manifest
+// records backend-specific IDs.
+type destination struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	// Folder defaults to the -folder flag.
+	Folder string `json:"folder,omitempty"`
+	// CredentialsDir is where this destination's Secret is mounted: it
+	// holds credentials.json and token.json for Drive, or the S3 settings
+	// files for S3.
+	CredentialsDir string `json:"credentialsDir,omitempty"`
+	// Auth is the Drive authentication mode, "auto" if empty. A key.json
+	// in CredentialsDir is a service account key; Subject is the user it
+	// impersonates, if any.
+	Auth    string `json:"auth,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// TokenSecret is the Secret mounted at CredentialsDir, which refreshed
+	// OAuth tokens are written back to.
+	TokenSecret string `json:"tokenSecret,omitempty"`
+	// SharedDrive is the ID or name of a Shared Drive for Drive
+	// destinations.
+	SharedDrive string `json:"sharedDrive,omitempty"`
+	// LocalDir is the target directory of a local destination.
+	LocalDir string `json:"localDir,omitempty"`
+}
+
+var destinationNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// loadDestinations reads and checks a JSON list of destinations.
+func loadDestinations(path string) ([]destination, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dests []destination
+	if err := json.Unmarshal(b, &dests); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("%s lists no destinations", path)
+	}
+	if err := checkDestinations(dests); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return dests, nil
+}
+
+// checkDestinations checks that each destination is complete and that names
+// are unique, since they name the manifests. Errors name the entry's field,
+// as in "[1].localDir".
+func checkDestinations(dests []destination) error {
+	seen := map[string]bool{}
+	for i, d := range dests {
+		field := fmt.Sprintf("[%d]", i)
+		if !destinationNameRE.MatchString(d.Name) {
+			return backupjob.FieldErrorf(field+".name", "%q must be lower-case letters, digits and dashes", d.Name)
+		}
+		if seen[d.Name] {
+			return backupjob.FieldErrorf(field+".name", "duplicate name %q", d.Name)
+		}
+		seen[d.Name] = true
+
+		switch d.Backend {
+		case "drive", "s3":
+			if d.CredentialsDir == "" && d.Auth != string(authMetadata) {
+				return backupjob.FieldErrorf(field+".credentialsDir", "%s destination %s needs credentialsDir", d.Backend, d.Name)
+			}
+			if d.Auth != "" {
+				if _, err := parseAuthMode(d.Auth); err != nil {
+					return backupjob.InField(field+".auth", err)
+				}
+			}
+		case "local":
+			if d.LocalDir == "" {
+				return backupjob.FieldErrorf(field+".localDir", "local destination %s needs localDir", d.Name)
+			}
+		default:
+			return backupjob.FieldErrorf(field+".backend", "unknown backend %q (want drive, s3 or local)", d.Backend)
+		}
+	}
+	return nil
+}
+
+// configDestinations returns the destinations a config file lists, checked
+// as those in destinations.json are.
+func configDestinations(cfg *backupjob.ConfigFile) ([]destination, error) {
+	var dests []destination
+	for _, d := range cfg.Destinations {
+		dests = append(dests, destination(d))
+	}
+	if err := checkDestinations(dests); err != nil {
+		return nil, backupjob.InField("destinations", err)
+	}
+	return dests, nil
+}
+
+// addDestinationFlag registers -destination, which picks the config's
+// destination for the commands that work on a single backend.
+func addDestinationFlag(fs *flag.FlagSet) *string {
+	return fs.String("destination", "", "name of the config's destination to use (default its only one)")
+}
+
+// pickDestination returns the destination called name, or the only one
+// there is if name is empty.
+func pickDestination(dests []destination, name string) (destination, error) {
+	var names []string
+	for _, d := range dests {
+		if d.Name == name || (name == "" && len(dests) == 1) {
+			return d, nil
+		}
+		names = append(names, d.Name)
+	}
+	if name == "" {
+		return destination{}, fmt.Errorf("the config lists %d destinations; choose one with -destination (%s)", len(dests), strings.Join(names, ", "))
+	}
+	return destination{}, fmt.Errorf("the config has no destination %q (want one of %s)", name, strings.Join(names, ", "))
+}
+
+// openStore opens the backend restore, snapshots and prune work on and
+// returns the backup folder in it: the config's destination, in its own
+// folder unless -folder is given, or the backend flags' backend when the
+// config lists no destinations or -backend is given.
+func openStore(fs *flag.FlagSet, backend backendFlags, cfg *backupjob.ConfigFile, name, folder string) (Backend, string) {
+	if cfg == nil || len(cfg.Destinations) == 0 || isFlagSet(fs, "backend") {
+		if name != "" {
+			log.Fatalf("-destination needs a config that lists destinations, and no -backend")
+		}
+		return backend.open(), folder
+	}
+	dests, err := configDestinations(cfg)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	d, err := pickDestination(dests, name)
+	if err != nil {
+		log.Fatalf("Invalid destination: %v", err)
+	}
+	store, err := d.open()
+	if err != nil {
+		log.Fatalf("Unable to open destination %s: %v", d.Name, err)
+	}
+	if d.Folder != "" && !isFlagSet(fs, "folder") {
+		folder = d.Folder
+	}
+	return store, folder
+}
+
+// open connects to the destination's backend. Unlike the single-destination
+// path it never prompts, since a fan-out run is unattended.
+func (d destination) open() (Backend, error) {
+	switch d.Backend {
+	case "drive":
+		client, srv, err := newDriveService(authOptions{
+			Mode:            authMode(d.Auth),
+			CredentialsFile: filepath.Join(d.CredentialsDir, "credentials.json"),
+			TokenFile:       filepath.Join(d.CredentialsDir, "token.json"),
+			KeyFile:         filepath.Join(d.CredentialsDir, "key.json"),
+			Subject:         d.Subject,
+			TokenSecret:     d.TokenSecret,
+		})
+		if err != nil {
+			return nil, err
+		}
+		store := newDriveBackend(client, srv)
+		if d.SharedDrive != "" {
+			if err := store.useSharedDrive(d.SharedDrive); err != nil {
+				return nil, err
+			}
+		}
+		return store, nil
+	case "s3":
+		cfg, err := loadS3Config(d.CredentialsDir)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Backend(cfg)
+	case "local":
+		return newLocalBackend(d.LocalDir)
+	}
+	return nil, fmt.Errorf("unknown backend %q", d.Backend)
+}
+
+// destinationManifest is where the manifest for destination name lives.
+func destinationManifest(source, name string) string {
+	return filepath.Join(source, ".drive-backup-manifest-"+name+".json")
+}
+
+// destinationResult is the outcome of backing up to one destination.
+type destinationResult struct {
+	Name  string
+	Stats backupStats
+	Err   error
+}
+
+// runFanOut backs opts.Source up to every destination in turn. A failing
+// destination does not stop the others; each gets its own result.
+func runFanOut(dests []destination, opts backupOptions) []destinationResult {
+	var manifests []string
+	for _, d := range dests {
+		manifests = append(manifests, destinationManifest(opts.Source, d.Name))
+	}
+
+	var results []destinationResult
+	for _, d := range dests {
+		log.Printf("Backing up to destination %s (%s)", d.Name, d.Backend)
+		o := opts
+		o.ManifestPath = destinationManifest(opts.Source, d.Name)
+		o.Exclude = append([]string{opts.ManifestPath}, manifests...)
+		if d.Folder != "" {
+			o.Folder = d.Folder
+		}
+
+		res := destinationResult{Name: d.Name}
+		if store, err := d.open(); err != nil {
+			res.Err = fmt.Errorf("unable to open backend: %w", err)
+		} else {
+			res.Stats, res.Err = runBackup(store, o)
+		}
+		if res.Err != nil {
+			log.Printf("Destination %s failed: %v", d.Name, res.Err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// printResults writes a per-destination summary table.
+func printResults(results []destinationResult) {
+	fmt.Printf("%-20s  %-6s  %8s  %6s  %9s  %7s  %6s  %s\n",
+		"DESTINATION", "STATUS", "UPLOADED", "MOVED", "UNCHANGED", "REMOVED", "FAILED", "ERROR")
+	for _, r := range results {
+		status, msg := "ok", ""
+		if r.Err != nil {
+			status, msg = "failed", strings.ReplaceAll(r.Err.Error(), "\n", " ")
+		}
+		s := r.Stats
+		fmt.Printf("%-20s  %-6s  %8d  %6d  %9d  %7d  %6d  %s\n",
+			r.Name, status, s.Uploaded, s.Moved, s.Unchanged, s.Removed, s.Failed, msg)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+const driveFileFields = "id, name, mimeType, size, md5Checksum, modifiedTime, headRevisionId"
+
+// driveBackend stores backups in Google Drive. The HTTP client is kept
+// alongside the service for the hand-rolled resumable upload protocol.
+type driveBackend struct {
+	client *http.Client
+	srv    *drive.Service
+	// driveID is the Shared Drive backups go into; empty means My Drive.
+	driveID string
+}
+
+func newDriveBackend(client *http.Client, srv *drive.Service) *driveBackend {
+	return &driveBackend{client: client, srv: srv}
+}
+
+// useSharedDrive makes rootFolderID refer to the top of a Shared Drive,
+// given by ID or by name.
+func (d *driveBackend) useSharedDrive(idOrName string) error {
+	if sd, err := d.srv.Drives.Get(idOrName).Fields("id").Do(); err == nil {
+		d.driveID = sd.Id
+		return nil
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	q := fmt.Sprintf("name = '%s'", escapeQuery(idOrName))
+	res, err := d.srv.Drives.List().Q(q).Fields("drives(id, name)").PageSize(2).Do()
+	if err != nil {
+		return err
+	}
+	switch len(res.Drives) {
+	case 0:
+		return fmt.Errorf("no Shared Drive with ID or name %q", idOrName)
+	case 1:
+		d.driveID = res.Drives[0].Id
+		return nil
+	}
+	return fmt.Errorf("more than one Shared Drive is called %q; use its ID", idOrName)
+}
+
+// folder maps rootFolderID to the Shared Drive, whose ID doubles as the ID
+// of its top-level folder.
+func (d *driveBackend) folder(id string) string {
+	if id == rootFolderID && d.driveID != "" {
+		return d.driveID
+	}
+	return id
+}
+
+// list starts a files.list call that sees Shared Drive items, restricted
+// to the configured Shared Drive if there is one.
+func (d *driveBackend) list(q string) *drive.FilesListCall {
+	call := d.srv.Files.List().Q(q).SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+	if d.driveID != "" {
+		call = call.Corpora("drive").DriveId(d.driveID)
+	}
+	return call
+}
+
+func (d *driveBackend) Stat(parentID, name string, folder bool) (*object, error) {
+	q := fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", escapeQuery(name), d.folder(parentID))
+	if folder {
+		q += fmt.Sprintf(" and mimeType = '%s'", folderMimeType)
+	} else {
+		q += fmt.Sprintf(" and mimeType != '%s'", folderMimeType)
+	}
+
+	res, err := d.list(q).Fields(googleapi.Field("files(" + driveFileFields + ")")).PageSize(1).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Files) == 0 {
+		return nil, nil
+	}
+	return driveObject(res.Files[0]), nil
+}
+
+func (d *driveBackend) List(folderID string) ([]*object, error) {
+	var objects []*object
+	q := fmt.Sprintf("'%s' in parents and trashed = false", d.folder(folderID))
+	err := d.list(q).
+		Fields(googleapi.Field("nextPageToken, files("+driveFileFields+")")).
+		PageSize(1000).
+		Pages(nil, func(page *drive.FileList) error {
+			for _, f := range page.Files {
+				objects = append(objects, driveObject(f))
+			}
+			return nil
+		})
+	return objects, err
+}
+
+func (d *driveBackend) Mkdir(parentID, name string) (string, error) {
+	existing, err := d.Stat(parentID, name, true)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return existing.ID, nil
+	}
+
+	f, err := d.srv.Files.Create(&drive.File{
+		Name:     name,
+		MimeType: folderMimeType,
+		Parents:  []string{d.folder(parentID)},
+	}).SupportsAllDrives(true).Fields("id").Do()
+	if err != nil {
+		return "", err
+	}
+	return f.Id, nil
+}
+
+func (d *driveBackend) Upload(parentID, name, fileID string, media io.Reader, modTime time.Time) (*object, error) {
+	var f *drive.File
+	var err error
+	if fileID != "" {
+		f, err = d.srv.Files.Update(fileID, &drive.File{ModifiedTime: driveTime(modTime)}).
+			Media(media).SupportsAllDrives(true).Fields(driveFileFields).Do()
+	} else {
+		f, err = d.srv.Files.Create(&drive.File{
+			Name:         name,
+			Parents:      []string{d.folder(parentID)},
+			ModifiedTime: driveTime(modTime),
+		}).Media(media).SupportsAllDrives(true).Fields(driveFileFields).Do()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driveObject(f), nil
+}
+
+func (d *driveBackend) Move(id, oldParentID, newParentID, name string) (string, error) {
+	call := d.srv.Files.Update(id, &drive.File{Name: name}).SupportsAllDrives(true).Fields("id")
+	if oldParentID != newParentID {
+		call = call.AddParents(d.folder(newParentID)).RemoveParents(d.folder(oldParentID))
+	}
+	if _, err := call.Do(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (d *driveBackend) Download(id string) (io.ReadCloser, error) {
+	res, err := d.srv.Files.Get(id).SupportsAllDrives(true).Download()
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (d *driveBackend) DownloadRange(id string, offset, length int64) (io.ReadCloser, error) {
+	call := d.srv.Files.Get(id).SupportsAllDrives(true)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	res, err := call.Download()
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (d *driveBackend) Delete(id string, trash bool) error {
+	var err error
+	if trash {
+		_, err = d.srv.Files.Update(id, &drive.File{Trashed: true}).SupportsAllDrives(true).Do()
+	} else {
+		err = d.srv.Files.Delete(id).SupportsAllDrives(true).Do()
+	}
+	return err
+}
+
+// PinRevision marks a revision keepForever so Drive does not purge it
+// after its usual 30 days, keeping older snapshots restorable.
+func (d *driveBackend) PinRevision(fileID, revisionID string) error {
+	_, err := d.srv.Revisions.Update(fileID, revisionID, &drive.Revision{KeepForever: true}).Do()
+	return err
+}
+
+func (d *driveBackend) DownloadRevision(fileID, revisionID string) (io.ReadCloser, error) {
+	res, err := d.srv.Revisions.Get(fileID, revisionID).Download()
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// DeleteRevision looks up the file's head revision first: Drive refuses to
+// delete it with the same status codes as quota and permission errors, so
+// the error alone does not say which it was.
+func (d *driveBackend) DeleteRevision(fileID, revisionID string) error {
+	f, err := d.srv.Files.Get(fileID).Fields("headRevisionId").SupportsAllDrives(true).Do()
+	if err != nil {
+		return err
+	}
+	if f.HeadRevisionId == revisionID {
+		return fmt.Errorf("%s of %s: %w", revisionID, fileID, errHeadRevision)
+	}
+	return d.srv.Revisions.Delete(fileID, revisionID).Do()
+}
+
+func driveObject(f *drive.File) *object {
+	o := &object{
+		ID:       f.Id,
+		Name:     f.Name,
+		Folder:   f.MimeType == folderMimeType,
+		Size:     f.Size,
+		MD5:      f.Md5Checksum,
+		Revision: f.HeadRevisionId,
+		Native:   f.MimeType != folderMimeType && strings.HasPrefix(f.MimeType, "application/vnd.google-apps."),
+	}
+	if t, err := time.Parse(time.RFC3339, f.ModifiedTime); err == nil {
+		o.ModTime = t
+	}
+	return o
+}
+
+// driveTime formats t the way Drive expects modifiedTime, so restores can
+// put the original mtime back.
+func driveTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// isNotFound reports whether err means the object does not exist, either
+// from a backend or as a Drive API 404.
+func isNotFound(err error) bool {
+	if errors.Is(err, errNotFound) {
+		return true
+	}
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// escapeQuery escapes a value for use inside a quoted Drive query string.
+func escapeQuery(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `'`, `\'`)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// pathFilter picks what a backup covers with glob patterns on paths
+// relative to the source, using forward slashes. A pattern without a slash
+// matches a file or directory name at any depth; one with a slash matches
+// a path from the source root. Matching a directory matches everything in
+// it.
+type pathFilter struct {
+	// Include, if not empty, limits the backup to the files it matches.
+	Include []string
+	// Exclude leaves out what it matches, even if included.
+	Exclude []string
+}
+
+// excludes reports whether rel, a file or directory, is left out.
+func (f pathFilter) excludes(rel string) bool {
+	return matchAny(f.Exclude, rel)
+}
+
+// includes reports whether the file rel is backed up, given that it is not
+// excluded.
+func (f pathFilter) includes(rel string) bool {
+	return len(f.Include) == 0 || matchAny(f.Include, rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern reports whether pattern matches rel or a directory it is in.
+func matchPattern(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		for _, name := range strings.Split(rel, "/") {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	for p := rel; ; {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
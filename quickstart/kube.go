@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's API credentials.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// errNotInCluster means there is no Kubernetes API to talk to, as when
+// running on a workstation.
+var errNotInCluster = errors.New("not running in a Kubernetes cluster")
+
+// kubeClient is a minimal client for the few Kubernetes API calls the
+// backup makes from inside its pod, authenticated with the pod's service
+// account.
+type kubeClient struct {
+	client    *http.Client
+	host      string
+	namespace string
+}
+
+func inClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errNotInCluster
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	return &kubeClient{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   30 * time.Second,
+		},
+		host:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(ns)),
+	}, nil
+}
+
+// kubeError is a failed API call, carrying the message from the returned
+// Status object.
+type kubeError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API: %d %s", e.Code, e.Message)
+}
+
+// patchSecretData merge-patches keys into the data of Secret name, leaving
+// other keys alone.
+func (k *kubeClient) patchSecretData(name string, data map[string][]byte) error {
+	// []byte marshals as base64, which is what Secret data holds.
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(k.namespace), url.PathEscape(name))
+	return k.do(http.MethodPatch, path, "application/merge-patch+json", body)
+}
+
+func (k *kubeClient) do(method, path, contentType string, body []byte) error {
+	// Projected service account tokens are rotated, so read it each time.
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	var status struct {
+		Message string `json:"message"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if json.Unmarshal(b, &status) != nil || status.Message == "" {
+		status.Message = strings.TrimSpace(string(b))
+	}
+	return &kubeError{Code: res.StatusCode, Message: status.Message}
+}
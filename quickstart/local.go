@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localTrashDir collects trashed objects at the top of a local backend.
+const localTrashDir = ".trash"
+
+// localBackend stores backups in a directory, such as an NFS mount. Object
+// IDs are slash-separated paths relative to the directory, with
+// rootFolderID standing for the directory itself.
+type localBackend struct {
+	dir string
+}
+
+func newLocalBackend(dir string) (*localBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localBackend{dir: dir}, nil
+}
+
+// path maps an object ID to a path on disk, refusing IDs that would escape
+// the backend directory.
+func (l *localBackend) path(id string) (string, error) {
+	if id == rootFolderID {
+		return l.dir, nil
+	}
+	clean := path.Clean("/" + id)
+	if clean == "/" || clean != "/"+id {
+		return "", fmt.Errorf("invalid object ID %q", id)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(id)), nil
+}
+
+func (l *localBackend) child(parentID, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	if parentID == rootFolderID {
+		return name, nil
+	}
+	return parentID + "/" + name, nil
+}
+
+func (l *localBackend) object(id string, info os.FileInfo) *object {
+	return &object{
+		ID:      id,
+		Name:    path.Base(id),
+		Folder:  info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
+
+func (l *localBackend) Stat(parentID, name string, folder bool) (*object, error) {
+	id, err := l.child(parentID, name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() != folder {
+		return nil, nil
+	}
+	return l.object(id, info), nil
+}
+
+func (l *localBackend) List(folderID string) ([]*object, error) {
+	p, err := l.path(folderID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", folderID, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*object
+	for _, e := range entries {
+		if folderID == rootFolderID && e.Name() == localTrashDir {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), ".upload-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		id, _ := l.child(folderID, e.Name())
+		objects = append(objects, l.object(id, info))
+	}
+	return objects, nil
+}
+
+func (l *localBackend) Mkdir(parentID, name string) (string, error) {
+	id, err := l.child(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	p, err := l.path(id)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(p, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return id, nil
+}
+
+// Upload writes media to a temporary file next to the target and renames it
+// into place, so readers never see a partly written file.
+func (l *localBackend) Upload(parentID, name, fileID string, media io.Reader, modTime time.Time) (*object, error) {
+	id := fileID
+	if id == "" {
+		var err error
+		if id, err = l.child(parentID, name); err != nil {
+			return nil, err
+		}
+	}
+	dest, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+	if fileID != "" {
+		if _, err := os.Stat(dest); os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", fileID, errNotFound)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), media); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		return nil, err
+	}
+	o := l.object(id, info)
+	o.MD5 = hex.EncodeToString(h.Sum(nil))
+	return o, nil
+}
+
+// Move renames the object on disk. Since IDs are paths, the returned ID is
+// the new path.
+func (l *localBackend) Move(id, oldParentID, newParentID, name string) (string, error) {
+	from, err := l.path(id)
+	if err != nil {
+		return "", err
+	}
+	newID, err := l.child(newParentID, name)
+	if err != nil {
+		return "", err
+	}
+	to, err := l.path(newID)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(from, to)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", id, errNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	return newID, nil
+}
+
+func (l *localBackend) Download(id string) (io.ReadCloser, error) {
+	p, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", id, errNotFound)
+	}
+	return f, err
+}
+
+func (l *localBackend) DownloadRange(id string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := l.Download(id)
+	if err != nil {
+		return nil, err
+	}
+	f := rc.(*os.File)
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+// Delete removes id, or moves it under the backend's .trash directory with
+// a timestamp prefix.
+func (l *localBackend) Delete(id string, trash bool) error {
+	p, err := l.path(id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", id, errNotFound)
+	}
+	if !trash {
+		return os.RemoveAll(p)
+	}
+
+	trashDir := filepath.Join(l.dir, localTrashDir)
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format(snapshotIDLayout)
+	return os.Rename(p, filepath.Join(trashDir, stamp+"-"+strings.ReplaceAll(id, "/", "_")))
+}
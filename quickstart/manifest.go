@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const manifestVersion = 1
+
+// manifestEntry records what was last uploaded for a single local file.
+type manifestEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	MD5      string    `json:"md5"`
+	FileID   string    `json:"fileId"`
+	ParentID string    `json:"parentId"`
+	// RevisionID is the Drive revision holding this version of the file.
+	RevisionID string `json:"revisionId,omitempty"`
+	// Chunks lists the file's content in chunked storage mode.
+	Chunks []string `json:"chunks,omitempty"`
+	// DeletedAt is when the local file was first found missing; only set
+	// while the Drive copy is kept, under the delete-after policy or for
+	// snapshots that still refer to it.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// manifest is the persisted state of previous backup runs, keyed by the
+// slash-separated path relative to the backup source.
+type manifest struct {
+	Version int    `json:"version"`
+	RootID  string `json:"rootId"`
+	// Encryption is the crypter mode the Drive copies were written with.
+	Encryption string `json:"encryption,omitempty"`
+	// Storage is the storage mode of the backup; empty means files.
+	Storage storageMode               `json:"storage,omitempty"`
+	Folders map[string]string         `json:"folders"`
+	Files   map[string]*manifestEntry `json:"files"`
+	// Uploads holds resumable uploads interrupted by an earlier run.
+	Uploads map[string]*uploadSession `json:"uploads,omitempty"`
+	// Chunks caches where every stored chunk lives in chunked mode.
+	Chunks map[string]chunkLocation `json:"chunkIndex,omitempty"`
+}
+
+func newManifest() *manifest {
+	return &manifest{
+		Version: manifestVersion,
+		Folders: map[string]string{},
+		Files:   map[string]*manifestEntry{},
+		Uploads: map[string]*uploadSession{},
+		Chunks:  map[string]chunkLocation{},
+	}
+}
+
+// loadManifest reads the manifest at path. A missing file yields an empty
+// manifest so the first run uploads everything.
+func loadManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return newManifest(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := newManifest()
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Folders == nil {
+		m.Folders = map[string]string{}
+	}
+	if m.Files == nil {
+		m.Files = map[string]*manifestEntry{}
+	}
+	if m.Uploads == nil {
+		m.Uploads = map[string]*uploadSession{}
+	}
+	if m.Chunks == nil {
+		m.Chunks = map[string]chunkLocation{}
+	}
+	return m, nil
+}
+
+// save writes the manifest to path via a temporary file so an interrupted
+// run never leaves a truncated manifest behind.
+func (m *manifest) save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reset forgets all Drive IDs, used when the backup folder itself changed.
+func (m *manifest) reset(rootID string) {
+	m.RootID = rootID
+	m.Folders = map[string]string{}
+	m.Files = map[string]*manifestEntry{}
+	m.Uploads = map[string]*uploadSession{}
+	m.Chunks = map[string]chunkLocation{}
+}
+
+// fileMD5 returns the hex MD5 digest of the file at path, matching the
+// format of Drive's md5Checksum field.
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,114 +1,507 @@
 package main
 
 import (
-    "bufio"
-    "context"
-    "encoding/json"
-    "fmt"
-    "io/ioutil"
-    "log"
-    "net/http"
-
-    "crypto/rand"
-    "encoding/base64"
-
-    "os"
-
-    "golang.org/x/oauth2"
-    "golang.org/x/oauth2/google"
-    "google.golang.org/api/drive/v3"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"backupjob"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 )
 
 func main() {
-    b, err := ioutil.ReadFile("credentials.json")
-    if err != nil {
-        log.Fatalf("Unable to read client secret file: %v", err)
-    }
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restoreMain(os.Args[2:])
+			return
+		case "snapshots":
+			snapshotsMain(os.Args[2:])
+			return
+		case "prune":
+			pruneMain(os.Args[2:])
+			return
+		}
+	}
+	backupMain(os.Args[1:])
+}
+
+// backupMain runs a backup pass; it is the default when no subcommand is
+// given so the CronJob container needs no arguments.
+func backupMain(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	source := fs.String("source", "backup", "directory to back up")
+	folder := fs.String("folder", "drive-backup", "name of the backup folder to back up into")
+	manifestPath := fs.String("manifest", "", "path of the sync manifest (default <source>/.drive-backup-manifest.json)")
+	deletion := fs.String("deletion", "keep", "what to do with remote copies of deleted files: keep, trash or delete-after (files a snapshot refers to stay until retention prunes it, see -keep-*)")
+	deleteAfterDays := fs.Int("delete-after-days", 30, "days a file must be missing before delete-after removes it")
+	resumableMB := fs.Int64("resumable-threshold-mb", 64, "files of at least this many MiB use resumable uploads (0 disables)")
+	snapshots := fs.Bool("snapshots", true, "record a point-in-time snapshot after the run (the local and s3 backends need -storage chunked to restore files changed since)")
+	storage := fs.String("storage", "files", "how to store data remotely: files (mirror the tree) or chunked (deduplicated packs)")
+	backend := addBackendFlags(fs)
+	destinations := fs.String("destinations", "destinations/destinations.json", "JSON list of destinations to back up to in one run; used if the file exists")
+	retention := addRetentionFlags(fs)
+	encryption := addEncryptionFlags(fs)
+	configPath := addConfigFlag(fs)
+	fs.Parse(args)
+
+	cfg, plaintext := loadConfig(fs, *configPath)
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(*source, ".drive-backup-manifest.json")
+	}
+
+	policy, err := parseDeletionPolicy(*deletion, *deleteAfterDays)
+	if err != nil {
+		log.Fatalf("Invalid deletion policy: %v", err)
+	}
+	if err := retention.validate(); err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	mode, err := parseStorageMode(*storage)
+	if err != nil {
+		log.Fatalf("Invalid storage mode: %v", err)
+	}
+	if msg := policy.heldBySnapshots(*snapshots || mode == storageChunked, *retention); msg != "" {
+		log.Print(msg)
+	}
+
+	crypt := encryption.open(fs, plaintext)
+
+	opts := backupOptions{
+		Source:             *source,
+		Folder:             *folder,
+		ManifestPath:       *manifestPath,
+		Deletion:           policy,
+		ResumableThreshold: *resumableMB << 20,
+		Snapshots:          *snapshots,
+		Retention:          *retention,
+		Crypt:              crypt,
+		Storage:            mode,
+	}
+
+	var dests []destination
+	if cfg != nil {
+		opts.Filter = pathFilter{Include: cfg.Source.Include, Exclude: cfg.Source.Exclude}
+		if len(cfg.Destinations) > 0 && !isFlagSet(fs, "destinations") {
+			if dests, err = configDestinations(cfg); err != nil {
+				log.Fatalf("Invalid config: %s: %v", *configPath, err)
+			}
+		}
+	}
+	if _, err := os.Stat(*destinations); dests == nil && (err == nil || isFlagSet(fs, "destinations")) {
+		if dests, err = loadDestinations(*destinations); err != nil {
+			log.Fatalf("Invalid destinations: %v", err)
+		}
+	}
+	if dests != nil {
+		results := runFanOut(dests, opts)
+		printResults(results)
+		for _, r := range results {
+			fatalIfRevoked(r.Err)
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				log.Fatalf("Backup failed for at least one destination")
+			}
+		}
+		return
+	}
+
+	if _, err := runBackup(backend.open(), opts); err != nil {
+		fatalIfRevoked(err)
+		log.Fatalf("Backup failed: %v", err)
+	}
+}
+
+// addConfigFlag registers -config on fs. Every command reads the same file,
+// so restore, snapshots and prune see the backup as it was written.
+func addConfigFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "config/backup.yaml", "backup config file (YAML or JSON) as stored by setup; used if the file exists, with flags given on the command line taking precedence")
+}
+
+// loadConfig reads the config file at path if it exists or -config was
+// given, and applies it to fs with applyConfigFlags. plaintext reports that
+// the config leaves encryption off, so a key file lying around is not used.
+func loadConfig(fs *flag.FlagSet, path string) (cfg *backupjob.ConfigFile, plaintext bool) {
+	if _, err := os.Stat(path); err != nil && !isFlagSet(fs, "config") {
+		return nil, false
+	}
+	cfg, err := backupjob.LoadConfigFile(path)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	applyConfigFlags(fs, cfg)
+	return cfg, !cfg.Encryption.Enabled && !isFlagSet(fs, "key-file")
+}
+
+// applyConfigFlags gives the flags of fs not set on the command line their
+// values from cfg. Turning encryption on sets -key-file, so a missing key is
+// an error rather than a plaintext backup.
+func applyConfigFlags(fs *flag.FlagSet, cfg *backupjob.ConfigFile) {
+	set := func(name, value string) {
+		if fs.Lookup(name) != nil && !isFlagSet(fs, name) {
+			fs.Set(name, value)
+		}
+	}
+	r := cfg.Retention
+	set("keep-last", strconv.Itoa(r.KeepLast))
+	set("keep-daily", strconv.Itoa(r.KeepDaily))
+	set("keep-weekly", strconv.Itoa(r.KeepWeekly))
+	set("keep-monthly", strconv.Itoa(r.KeepMonthly))
+	if cfg.Encryption.Enabled {
+		set("key-file", fs.Lookup("key-file").Value.String())
+		set("encrypt-names", strconv.FormatBool(cfg.Encryption.EncryptNames))
+	}
+}
+
+// exitTokenRevoked is the exit status when the OAuth login is no longer
+// usable, so alerting can tell it apart from an ordinary failed run.
+const exitTokenRevoked = 3
+
+// terminationLog is where Kubernetes picks up a container's termination
+// message, shown by kubectl describe and in the pod status.
+const terminationLog = "/dev/termination-log"
+
+// fatalIfRevoked exits with exitTokenRevoked if err is a revoked OAuth
+// token, leaving the reason as the termination message.
+func fatalIfRevoked(err error) {
+	if !errors.Is(err, errTokenRevoked) {
+		return
+	}
+	msg := "Drive login revoked, run setup to log in again: " + err.Error()
+	log.Print(msg)
+	os.WriteFile(terminationLog, []byte(msg), 0644)
+	os.Exit(exitTokenRevoked)
+}
 
-    config, err := google.ConfigFromJSON(b, drive.DriveScope)
-    if err != nil {
-        log.Fatalf("Unable to parse client secret file to config: %v", err)
-    }
+// restoreMain implements "quickstart restore [flags] <target-dir>".
+func restoreMain(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	folder := fs.String("folder", "drive-backup", "name of the backup folder to restore from")
+	pattern := fs.String("path", "", "only restore this path or glob within the backup")
+	conflict := fs.String("conflict", "skip", "what to do with existing local files: skip, overwrite or rename")
+	dryRun := fs.Bool("dry-run", false, "list what would be restored without writing anything")
+	snapshotID := fs.String("snapshot", "", "restore the state recorded by this snapshot ID, or \"latest\"")
+	backend := addBackendFlags(fs)
+	encryption := addEncryptionFlags(fs)
+	configPath := addConfigFlag(fs)
+	destName := addDestinationFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: quickstart restore [flags] <target-dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
 
-    _ = getClient(config)
+	cfg, plaintext := loadConfig(fs, *configPath)
+	policy, err := parseConflictPolicy(*conflict)
+	if err != nil {
+		log.Fatalf("Invalid conflict policy: %v", err)
+	}
 
-    }
+	crypt := encryption.open(fs, plaintext)
+	store, from := openStore(fs, backend, cfg, *destName, *folder)
 
+	opts := restoreOptions{
+		Folder:   from,
+		Target:   fs.Arg(0),
+		Pattern:  *pattern,
+		Conflict: policy,
+		DryRun:   *dryRun,
+		Snapshot: *snapshotID,
+		Crypt:    crypt,
+	}
+	if err := runRestore(store, opts); err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+}
+
+// snapshotsMain implements "quickstart snapshots list".
+func snapshotsMain(args []string) {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	folder := fs.String("folder", "drive-backup", "name of the backup folder")
+	backend := addBackendFlags(fs)
+	encryption := addEncryptionFlags(fs)
+	configPath := addConfigFlag(fs)
+	destName := addDestinationFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: quickstart snapshots list [flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "list" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+
+	cfg, plaintext := loadConfig(fs, *configPath)
+	crypt := encryption.open(fs, plaintext)
+	store, from := openStore(fs, backend, cfg, *destName, *folder)
+
+	if err := printSnapshots(store, crypt, from); err != nil {
+		log.Fatalf("Unable to list snapshots: %v", err)
+	}
+}
+
+// pruneMain implements "quickstart prune [flags]".
+func pruneMain(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	folder := fs.String("folder", "drive-backup", "name of the backup folder")
+	dryRun := fs.Bool("dry-run", false, "print what would be removed without removing it")
+	backend := addBackendFlags(fs)
+	retention := addRetentionFlags(fs)
+	encryption := addEncryptionFlags(fs)
+	configPath := addConfigFlag(fs)
+	destName := addDestinationFlag(fs)
+	fs.Parse(args)
+
+	cfg, plaintext := loadConfig(fs, *configPath)
+	if err := retention.validate(); err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	if !retention.enabled() {
+		log.Fatalf("Refusing to prune without a retention policy; pass at least one -keep-* flag or set retention in the config")
+	}
+
+	crypt := encryption.open(fs, plaintext)
+	store, from := openStore(fs, backend, cfg, *destName, *folder)
+
+	root, err := store.Stat(rootFolderID, from, true)
+	if err != nil {
+		log.Fatalf("Unable to resolve backup folder %q: %v", from, err)
+	}
+	if root == nil {
+		log.Fatalf("Backup folder %q not found", from)
+	}
+	if err := pruneSnapshots(store, crypt, root.ID, *retention, nil, *dryRun); err != nil {
+		log.Fatalf("Prune failed: %v", err)
+	}
+}
 
+// backendFlags selects where backups are stored.
+type backendFlags struct {
+	kind        *string
+	auth        *string
+	saKey       *string
+	subject     *string
+	tokenSecret *string
+	sharedDrive *string
+	localDir    *string
+	s3Dir       *string
+	s3Endpoint  *string
+	s3Bucket    *string
+	s3Prefix    *string
+	s3Region    *string
+}
+
+// addBackendFlags registers the storage backend flags on fs.
+func addBackendFlags(fs *flag.FlagSet) backendFlags {
+	return backendFlags{
+		kind:        fs.String("backend", "", "where to store backups: drive, s3 or local (default s3 if the S3 Secret is mounted, else drive)"),
+		auth:        fs.String("auth", "auto", "Drive authentication: auto, oauth, service-account or metadata"),
+		saKey:       fs.String("service-account-key", "service-account/key.json", "service account JSON key; auto uses it if the file exists"),
+		subject:     fs.String("subject", "", "user a service account impersonates through domain-wide delegation"),
+		tokenSecret: fs.String("token-secret", "token", "Kubernetes Secret to write refreshed OAuth tokens back to when running in a cluster"),
+		sharedDrive: fs.String("shared-drive", "", "ID or name of the Shared Drive to use instead of My Drive"),
+		localDir:    fs.String("local-dir", "", "directory the local backend stores backups in, e.g. an NFS mount"),
+		s3Dir:       fs.String("s3-config-dir", "s3", "directory holding the S3 settings and keys, one file per field"),
+		s3Endpoint:  fs.String("s3-endpoint", "", "S3 endpoint URL, e.g. http://minio:9000 (overrides s3-config-dir)"),
+		s3Bucket:    fs.String("s3-bucket", "", "S3 bucket (overrides s3-config-dir)"),
+		s3Prefix:    fs.String("s3-prefix", "", "key prefix inside the bucket (overrides s3-config-dir)"),
+		s3Region:    fs.String("s3-region", "", "S3 region (default us-east-1)"),
+	}
+}
 
+// open connects to the selected backend. Only the Drive backend needs the
+// OAuth credentials and token.
+func (b backendFlags) open() Backend {
+	kind := *b.kind
+	if kind == "" {
+		kind = "drive"
+		if _, err := os.Stat(filepath.Join(*b.s3Dir, "bucket")); err == nil {
+			kind = "s3"
+		}
+	}
 
-func getClient(config *oauth2.Config) *http.Client {
-    tokFile := "token.json"
-    tok, err := tokenFromFile(tokFile)
-    if err != nil {
-        tok = getTokenFromWeb(config)
-        saveToken(tokFile, tok)
-    } else {
-        reader := bufio.NewReader(os.Stdin)
-        fmt.Print("Do you want to logout? (yes/no): ")
-        text, _ := reader.ReadString('\n')
-        if text == "yes\n" {
-            os.Remove(tokFile)
-            tok = getTokenFromWeb(config)
-            saveToken(tokFile, tok)
-        }
-    }
-    return config.Client(context.Background(), tok)
+	switch kind {
+	case "s3":
+		cfg, err := loadS3Config(*b.s3Dir)
+		if err != nil {
+			log.Fatalf("Unable to read S3 settings: %v", err)
+		}
+		override(&cfg.Endpoint, *b.s3Endpoint)
+		override(&cfg.Bucket, *b.s3Bucket)
+		override(&cfg.Prefix, *b.s3Prefix)
+		override(&cfg.Region, *b.s3Region)
+		// Keys may also come from the usual AWS environment variables.
+		if cfg.AccessKey == "" {
+			cfg.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if cfg.SecretKey == "" {
+			cfg.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		store, err := newS3Backend(cfg)
+		if err != nil {
+			log.Fatalf("Unable to open S3 backend: %v", err)
+		}
+		return store
+	case "drive":
+		mode, err := parseAuthMode(*b.auth)
+		if err != nil {
+			log.Fatalf("Invalid auth mode: %v", err)
+		}
+		client, srv, err := newDriveService(authOptions{
+			Mode:            mode,
+			CredentialsFile: "credentials.json",
+			TokenFile:       "token.json",
+			KeyFile:         *b.saKey,
+			Subject:         *b.subject,
+			Interactive:     isTerminal(),
+			TokenSecret:     *b.tokenSecret,
+		})
+		if err != nil {
+			fatalIfRevoked(err)
+			log.Fatalf("Unable to authenticate to Drive: %v", err)
+		}
+		store := newDriveBackend(client, srv)
+		if *b.sharedDrive != "" {
+			if err := store.useSharedDrive(*b.sharedDrive); err != nil {
+				log.Fatalf("Unable to open Shared Drive: %v", err)
+			}
+		}
+		return store
+	case "local":
+		if *b.localDir == "" {
+			log.Fatalf("The local backend needs -local-dir")
+		}
+		store, err := newLocalBackend(*b.localDir)
+		if err != nil {
+			log.Fatalf("Unable to open local backend: %v", err)
+		}
+		return store
+	}
+	log.Fatalf("Unknown backend %q (want drive, s3 or local)", kind)
+	return nil
 }
 
+// override sets *field to value unless value is empty.
+func override(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
 
+// encryptionFlags are the client-side encryption flags.
+type encryptionFlags struct {
+	keyFile        *string
+	encryptNames   *bool
+	allowPlaintext *bool
+}
 
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-    state := randToken()
-    authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
-    codeCh := make(chan string)
+// addEncryptionFlags registers the client-side encryption flags on fs.
+func addEncryptionFlags(fs *flag.FlagSet) encryptionFlags {
+	return encryptionFlags{
+		keyFile:        fs.String("key-file", "keys/encryption.key", "32-byte encryption key (raw, hex or base64); encryption is on if the file exists"),
+		encryptNames:   fs.Bool("encrypt-names", false, "also encrypt file and folder names"),
+		allowPlaintext: fs.Bool("allow-plaintext", false, "with a key, also read unencrypted data, as backed up before encryption was turned on; it is not authenticated"),
+	}
+}
 
-    go func() {
-        http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-            if r.FormValue("state") != state {
-                http.Error(w, "State invalid", http.StatusBadRequest)
-                codeCh <- "State invalid"
-                return
-            }
+// open loads the encryption key. The default key file is optional so the
+// CronJob only encrypts when the key Secret is mounted; a key file named
+// explicitly on the command line must exist. plaintext, from loadConfig,
+// means the config turns encryption off, so no key is loaded.
+func (e encryptionFlags) open(fs *flag.FlagSet, plaintext bool) *crypter {
+	if plaintext {
+		return nil
+	}
+	keyFile := *e.keyFile
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) && !isFlagSet(fs, "key-file") {
+		if *e.encryptNames {
+			log.Fatalf("-encrypt-names needs an encryption key, but %s does not exist", keyFile)
+		}
+		return nil
+	}
 
-            codeCh <- r.FormValue("code")
-        })
+	c, err := loadCrypter(keyFile, *e.encryptNames)
+	if err != nil {
+		log.Fatalf("Unable to load encryption key: %v", err)
+	}
+	c.allowPlaintext = *e.allowPlaintext
+	return c
+}
 
-        log.Fatal(http.ListenAndServe(":8080", nil))
-    }()
+// isFlagSet reports whether the flag called name was given on the command
+// line, as opposed to holding its default.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-    fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-    code := <-codeCh
-    tok, err := config.Exchange(context.TODO(), code)
-    if err != nil {
-        log.Fatalf("Unable to retrieve token from web: %v", err)
-    }
-    return tok
+// newDriveService authenticates as configured by auth and returns an
+// authorized HTTP client together with a Drive service using it.
+func newDriveService(auth authOptions) (*http.Client, *drive.Service, error) {
+	ctx := context.Background()
+	ts, err := auth.tokenSource(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Fetch a token now, refreshing it if needed, so a revoked login fails
+	// up front rather than once per file.
+	if _, err := ts.Token(); err != nil {
+		return nil, nil, err
+	}
+	client := oauth2.NewClient(ctx, ts)
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve Drive client: %v", err)
+	}
+	return client, srv, nil
 }
 
-func randToken() string {
-    b := make([]byte, 32)
-    rand.Read(b)
-    return base64.StdEncoding.EncodeToString(b)
+// loginTimeout bounds how long the browser login waits for consent.
+const loginTimeout = 5 * time.Minute
+
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+	l := &backupjob.LoopbackLogin{Config: config, Timeout: loginTimeout}
+	return l.Login(context.Background())
 }
 
 func saveToken(path string, token *oauth2.Token) {
-    //fmt.Printf("Saving credential file to: %s\n", path)
-    f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-    if err != nil {
-        log.Fatalf("Unable to cache oauth token: %v", err)
-    }
-    defer f.Close()
-    json.NewEncoder(f).Encode(token)
+	//fmt.Printf("Saving credential file to: %s\n", path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalf("Unable to cache oauth token: %v", err)
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(token)
 }
 
 func tokenFromFile(file string) (*oauth2.Token, error) {
-    f, err := os.Open(file)
-    if err != nil {
-        return nil, err
-    }
-    t := &oauth2.Token{}
-    err = json.NewDecoder(f).Decode(t)
-    defer f.Close()
-    return t, err
-}
\ No newline at end of file
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	t := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(t)
+	defer f.Close()
+	return t, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConfigBackupRestore backs up and restores with nothing but the same
+// config file, which encrypts names and sends the backup to a destination
+// with its own folder.
+func TestConfigBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	source, remote, target := filepath.Join(dir, "photos"), filepath.Join(dir, "nas"), filepath.Join(dir, "restored")
+	files := map[string]string{"a.txt": "first", "album/b.txt": "second"}
+	for name, content := range files {
+		p := filepath.Join(source, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(remote, 0755); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "encryption.key")
+	if err := os.WriteFile(keyFile, bytes.Repeat([]byte{7}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "backup.yaml")
+	yaml := fmt.Sprintf(`apiVersion: drive-backup/v1
+name: photos
+schedule:
+  cron: "@daily"
+source:
+  path: photos
+destinations:
+- name: nas
+  backend: local
+  localDir: %q
+  folder: photos-backup
+encryption:
+  enabled: true
+  encryptNames: true
+`, remote)
+	if err := os.WriteFile(config, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backupMain([]string{"-config", config, "-key-file", keyFile, "-source", source})
+	if _, err := os.Stat(filepath.Join(remote, "photos-backup")); err != nil {
+		t.Fatalf("backup is not in the destination's folder: %v", err)
+	}
+	filepath.WalkDir(remote, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && (d.Name() == "a.txt" || d.Name() == "album") {
+			t.Errorf("backup has a plain name: %s", p)
+		}
+		return err
+	})
+
+	restoreMain([]string{"-config", config, "-key-file", keyFile, target})
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("restored %s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestPickDestination(t *testing.T) {
+	one := []destination{{Name: "nas"}}
+	two := []destination{{Name: "nas"}, {Name: "cloud"}}
+	tests := []struct {
+		dests []destination
+		name  string
+		want  string // empty if it must fail
+	}{
+		{one, "", "nas"},
+		{one, "nas", "nas"},
+		{one, "cloud", ""},
+		{two, "cloud", "cloud"},
+		{two, "", ""},
+	}
+	for _, tt := range tests {
+		d, err := pickDestination(tt.dests, tt.name)
+		if tt.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "nas") {
+				t.Errorf("pickDestination(%d, %q) = %s, %v; want an error naming the choices", len(tt.dests), tt.name, d.Name, err)
+			}
+			continue
+		}
+		if err != nil || d.Name != tt.want {
+			t.Errorf("pickDestination(%d, %q) = %s, %v; want %s", len(tt.dests), tt.name, d.Name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// conflictPolicy says what restore does when the target file already exists.
+type conflictPolicy string
+
+const (
+	conflictSkip      conflictPolicy = "skip"
+	conflictOverwrite conflictPolicy = "overwrite"
+	conflictRename    conflictPolicy = "rename"
+)
+
+func parseConflictPolicy(s string) (conflictPolicy, error) {
+	switch conflictPolicy(s) {
+	case conflictSkip, conflictOverwrite, conflictRename:
+		return conflictPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q (want skip, overwrite or rename)", s)
+}
+
+// restoreOptions configures a restore run.
+type restoreOptions struct {
+	Folder string
+	Target string
+	// Pattern limits the restore to one path or glob within the backup,
+	// matched against slash-separated relative paths. A directory path
+	// selects everything beneath it.
+	Pattern  string
+	Conflict conflictPolicy
+	DryRun   bool
+	// Snapshot restores the files as of the given snapshot ID ("latest"
+	// for the newest) instead of the current contents of the folder.
+	Snapshot string
+	// Crypt decrypts backups written with client-side encryption.
+	Crypt *crypter
+}
+
+// remoteFile is a file found in the remote backup tree. RevisionID and MD5
+// are only set when restoring from a snapshot; Chunked files are
+// reassembled from Chunks using the snapshot's chunk locations.
+type remoteFile struct {
+	Rel        string
+	File       *object
+	RevisionID string
+	// MD5 is the plaintext digest the snapshot recorded, checked after
+	// download.
+	MD5       string
+	Chunked   bool
+	Chunks    []string
+	Locations map[string]chunkLocation
+}
+
+// runRestore downloads the backup folder opts.Folder, or the part of
+// it selected by opts.Pattern, into opts.Target.
+func runRestore(store Backend, opts restoreOptions) error {
+	root, err := store.Stat(rootFolderID, opts.Folder, true)
+	if err != nil {
+		return fmt.Errorf("unable to resolve backup folder %q: %v", opts.Folder, err)
+	}
+	if root == nil {
+		return fmt.Errorf("backup folder %q not found", opts.Folder)
+	}
+
+	if opts.Snapshot == "" {
+		chunks, err := store.Stat(root.ID, chunksFolderName, true)
+		if err != nil {
+			return fmt.Errorf("unable to inspect backup folder: %v", err)
+		}
+		if chunks != nil {
+			log.Printf("Backup uses chunked storage; restoring the latest snapshot")
+			opts.Snapshot = "latest"
+		}
+	}
+
+	var files []remoteFile
+	if opts.Snapshot != "" {
+		snap, err := loadSnapshot(store, opts.Crypt, root.ID, opts.Snapshot)
+		if err != nil {
+			return fmt.Errorf("unable to load snapshot: %v", err)
+		}
+		log.Printf("Restoring snapshot %s taken %s", snap.ID, snap.Time.Local().Format(time.RFC1123))
+		files = snapshotFiles(snap)
+	} else {
+		files, err = listTree(store, opts.Crypt, root.ID, ".")
+		if err != nil {
+			return fmt.Errorf("unable to list backup folder: %v", err)
+		}
+	}
+
+	var restored, skipped, failed int
+	for _, rf := range files {
+		if !matchesPattern(opts.Pattern, rf.Rel) {
+			continue
+		}
+		if rf.File.Native {
+			log.Printf("Skipping %s: native Google file cannot be downloaded", rf.Rel)
+			skipped++
+			continue
+		}
+
+		dest, err := restorePath(opts.Target, rf.Rel)
+		if err != nil {
+			log.Printf("Unable to restore %s: %v", rf.Rel, err)
+			failed++
+			continue
+		}
+		dest, ok, err := resolveConflict(dest, opts.Conflict)
+		if err != nil {
+			log.Printf("Unable to restore %s: %v", rf.Rel, err)
+			failed++
+			continue
+		}
+		if !ok {
+			if opts.DryRun {
+				fmt.Printf("skip      %s (exists)\n", rf.Rel)
+			}
+			skipped++
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Printf("restore   %s -> %s (%d bytes)\n", rf.Rel, dest, rf.File.Size)
+			restored++
+			continue
+		}
+		if err := downloadFile(store, opts.Crypt, rf, dest); err != nil {
+			log.Printf("Unable to restore %s: %v", rf.Rel, err)
+			failed++
+			continue
+		}
+		restored++
+	}
+
+	verb := "restored"
+	if opts.DryRun {
+		verb = "would be restored"
+	}
+	log.Printf("Restore finished: %d %s, %d skipped, %d failed", restored, verb, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to restore", failed)
+	}
+	return nil
+}
+
+// listTree recursively lists all non-folder files below folderID, with paths
+// relative to the top of the walk. Encrypted names are decrypted; names that
+// do not decrypt were uploaded before name encryption and are kept as is.
+func listTree(store Backend, c *crypter, folderID, rel string) ([]remoteFile, error) {
+	objects, err := store.List(folderID)
+	if err != nil {
+		return nil, err
+	}
+	var files []remoteFile
+	for _, o := range objects {
+		if rel == "." && (o.Name == snapshotsFolderName || o.Name == chunksFolderName) {
+			continue
+		}
+		if name, err := c.decryptName(o.Name); err == nil {
+			o.Name = name
+		}
+		if o.Name == "." || o.Name == ".." || strings.ContainsAny(o.Name, `/\`) {
+			log.Printf("Skipping %q in %s: name is not a valid local path", o.Name, rel)
+			continue
+		}
+		child := path.Join(rel, o.Name)
+		if o.Folder {
+			sub, err := listTree(store, c, o.ID, child)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+		files = append(files, remoteFile{Rel: child, File: o})
+	}
+	return files, nil
+}
+
+// snapshotFiles turns a snapshot index into the list of files to restore,
+// sorted by path.
+func snapshotFiles(snap *snapshot) []remoteFile {
+	files := make([]remoteFile, 0, len(snap.Files))
+	for rel, f := range snap.Files {
+		files = append(files, remoteFile{
+			Rel: rel,
+			File: &object{
+				ID:      f.FileID,
+				Size:    f.Size,
+				ModTime: f.ModTime,
+			},
+			RevisionID: f.RevisionID,
+			MD5:        f.MD5,
+			Chunked:    f.FileID == "",
+			Chunks:     f.Chunks,
+			Locations:  snap.Chunks,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Rel < files[j].Rel })
+	return files
+}
+
+// restorePath returns where the backup's file rel goes under target. The
+// path comes from the remote, so one that would land outside target is an
+// error rather than a write elsewhere on disk.
+func restorePath(target, rel string) (string, error) {
+	if rel == "" || path.IsAbs(rel) || strings.Contains(rel, `\`) || filepath.IsAbs(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("invalid path %q in backup", rel)
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid path %q in backup", rel)
+		}
+	}
+	root := filepath.Clean(target)
+	dest := filepath.Join(root, filepath.FromSlash(rel))
+	if r, err := filepath.Rel(root, dest); err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q in backup is outside the restore target", rel)
+	}
+	return dest, nil
+}
+
+// matchesPattern reports whether rel is selected by pattern: an empty
+// pattern selects everything, otherwise rel or one of its parent
+// directories must match the glob.
+func matchesPattern(pattern, rel string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return true
+	}
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConflict decides where a restored file goes when dest already
+// exists. It returns false if the file should be skipped.
+func resolveConflict(dest string, policy conflictPolicy) (string, bool, error) {
+	_, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return dest, true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	switch policy {
+	case conflictOverwrite:
+		return dest, true, nil
+	case conflictRename:
+		ext := filepath.Ext(dest)
+		base := strings.TrimSuffix(dest, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s (restored %d)%s", base, i, ext)
+			if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+				return candidate, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// writeContents copies a mirrored file, or one of its revisions, to w.
+// Backends without revisions only have the current contents.
+func writeContents(store Backend, c *crypter, rf remoteFile, w io.Writer) error {
+	var rc io.ReadCloser
+	var err error
+	if revs, ok := store.(revisionStore); ok && rf.RevisionID != "" {
+		rc, err = revs.DownloadRevision(rf.File.ID, rf.RevisionID)
+	} else {
+		rc, err = store.Download(rf.File.ID)
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	body, err := c.openReader(rc)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// writeChunks reassembles a chunked file into w.
+func writeChunks(store Backend, c *crypter, rf remoteFile, w io.Writer) error {
+	for _, id := range rf.Chunks {
+		loc, ok := rf.Locations[id]
+		if !ok {
+			return fmt.Errorf("snapshot does not locate chunk %s", id)
+		}
+		data, err := readChunk(store, c, id, loc)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadFile writes the contents of rf to dest through a temporary file
+// and sets dest's mtime to the remote modification time. A pinned revision is
+// downloaded instead of the current contents when rf names one, and
+// encrypted contents are decrypted on the way. Contents that do not match
+// the snapshot's digest are an error and dest is left alone.
+func downloadFile(store Backend, c *crypter, rf remoteFile, dest string) error {
+	f := rf.File
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	w := io.MultiWriter(tmp, h)
+	if rf.Chunked {
+		err = writeChunks(store, c, rf, w)
+	} else {
+		err = writeContents(store, c, rf, w)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); err == nil && rf.MD5 != "" && sum != rf.MD5 {
+		err = fmt.Errorf("contents do not match the snapshot (got MD5 %s, want %s)", sum, rf.MD5)
+		if _, ok := store.(revisionStore); !ok && !rf.Chunked {
+			err = fmt.Errorf("file changed after the snapshot and the backend keeps no old versions; use -storage chunked for point-in-time restores")
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	if !f.ModTime.IsZero() {
+		if err := os.Chtimes(dest, f.ModTime, f.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestorePath(t *testing.T) {
+	target := filepath.Join("restore", "target")
+	tests := []struct {
+		rel  string
+		want string // empty if rel must be refused
+	}{
+		{"a.txt", filepath.Join(target, "a.txt")},
+		{"dir/sub/a.txt", filepath.Join(target, "dir", "sub", "a.txt")},
+		{"./a.txt", filepath.Join(target, "a.txt")},
+		{"dir/../a.txt", ""},
+		{"../a.txt", ""},
+		{"../../etc/x", ""},
+		{"dir/..", ""},
+		{"..", ""},
+		{".", ""},
+		{"", ""},
+		{"/etc/passwd", ""},
+		{`..\a.txt`, ""},
+	}
+	for _, tt := range tests {
+		got, err := restorePath(target+string(filepath.Separator), tt.rel)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("restorePath(%q) = %q, want an error", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("restorePath(%q) = %q, %v; want %q", tt.rel, got, err, tt.want)
+		}
+	}
+}
+
+// TestRestoreRefusesEscapingSnapshotPaths restores a snapshot whose index
+// names files outside the target, as a tampered remote could.
+func TestRestoreRefusesEscapingSnapshotPaths(t *testing.T) {
+	remote, dir := t.TempDir(), t.TempDir()
+	target := filepath.Join(dir, "target")
+	store, err := newLocalBackend(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootID, err := store.Mkdir(rootFolderID, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := store.Upload(rootID, "a.txt", "", strings.NewReader("payload"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := snapshot{
+		ID:   "20240101T000000Z",
+		Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Files: map[string]*snapshotFile{
+			"../escaped.txt":  {FileID: obj.ID, MD5: obj.MD5, Size: obj.Size},
+			"a/../../up.txt":  {FileID: obj.ID, MD5: obj.MD5, Size: obj.Size},
+			"inside/file.txt": {FileID: obj.ID, MD5: obj.MD5, Size: obj.Size},
+		},
+	}
+	putSnapshot(t, store, rootID, &snap)
+
+	err = runRestore(store, restoreOptions{Folder: "backup", Target: target, Conflict: conflictSkip, Snapshot: "latest"})
+	if err == nil {
+		t.Error("restore of escaping paths succeeded")
+	}
+	for _, p := range []string{filepath.Join(dir, "escaped.txt"), filepath.Join(dir, "up.txt")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was written outside the restore target", p)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(target, "inside", "file.txt")); err != nil || string(b) != "payload" {
+		t.Errorf("file inside the target = %q, %v; want it restored", b, err)
+	}
+}
+
+// putSnapshot stores snap under the backup folder rootID as an unencrypted
+// backup run would.
+func putSnapshot(t *testing.T, store Backend, rootID string, snap *snapshot) {
+	t.Helper()
+	body, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folderID, err := store.Mkdir(rootID, snapshotsFolderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Upload(folderID, snap.ID+".json", "", strings.NewReader(string(body)), snap.Time); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// retentionPolicy is a grandfather-father-son style rule set for snapshots.
+// A snapshot survives pruning if any rule keeps it; the newest snapshot is
+// always kept. A zero policy keeps everything.
+type retentionPolicy struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// addRetentionFlags registers the -keep-* flags on fs.
+func addRetentionFlags(fs *flag.FlagSet) *retentionPolicy {
+	p := &retentionPolicy{}
+	fs.IntVar(&p.Last, "keep-last", 0, "keep the N most recent snapshots")
+	fs.IntVar(&p.Daily, "keep-daily", 0, "keep the newest snapshot of each of the last N days with snapshots")
+	fs.IntVar(&p.Weekly, "keep-weekly", 0, "keep the newest snapshot of each of the last N weeks with snapshots")
+	fs.IntVar(&p.Monthly, "keep-monthly", 0, "keep the newest snapshot of each of the last N months with snapshots")
+	return p
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.Last > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0
+}
+
+func (p retentionPolicy) validate() error {
+	if p.Last < 0 || p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 {
+		return fmt.Errorf("keep counts must not be negative")
+	}
+	return nil
+}
+
+// revisionKey identifies one Drive revision of one file.
+type revisionKey struct {
+	FileID     string
+	RevisionID string
+}
+
+// selectSnapshots splits snaps into those the policy keeps and those it
+// prunes. snaps may be in any order; both results are newest first.
+func selectSnapshots(snaps []*snapshot, p retentionPolicy) (keep, prune []*snapshot) {
+	sorted := append([]*snapshot(nil), snaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.After(sorted[j].Time) })
+	if !p.enabled() {
+		return sorted, nil
+	}
+
+	buckets := []struct {
+		limit int
+		key   func(time.Time) string
+		seen  map[string]bool
+	}{
+		{p.Last, func(t time.Time) string { return t.Format(time.RFC3339Nano) }, map[string]bool{}},
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }, map[string]bool{}},
+		{p.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}, map[string]bool{}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }, map[string]bool{}},
+	}
+
+	for i, snap := range sorted {
+		t := snap.Time.Local()
+		kept := i == 0
+		for b := range buckets {
+			bucket := &buckets[b]
+			if len(bucket.seen) >= bucket.limit {
+				continue
+			}
+			k := bucket.key(t)
+			if !bucket.seen[k] {
+				bucket.seen[k] = true
+				kept = true
+			}
+		}
+		if kept {
+			keep = append(keep, snap)
+		} else {
+			prune = append(prune, snap)
+		}
+	}
+	return keep, prune
+}
+
+// pruneSnapshots applies policy to the snapshots under rootID: expired
+// snapshot indexes are deleted, as are the revisions and chunk packs
+// only they referenced. Revisions in protect (the files' current state) are never
+// touched. With dryRun set nothing is changed and the plan is printed.
+func pruneSnapshots(store Backend, c *crypter, rootID string, policy retentionPolicy, protect map[revisionKey]bool, dryRun bool) error {
+	infos, err := listSnapshots(store, rootID)
+	if err != nil {
+		return err
+	}
+
+	snaps := make([]*snapshot, 0, len(infos))
+	byID := map[string]snapshotInfo{}
+	for _, info := range infos {
+		snap, err := downloadSnapshot(store, c, info)
+		if err != nil {
+			return err
+		}
+		snaps = append(snaps, snap)
+		byID[snap.ID] = info
+	}
+
+	keep, prune := selectSnapshots(snaps, policy)
+	if len(prune) == 0 {
+		log.Printf("Retention: keeping all %d snapshots", len(keep))
+		return nil
+	}
+
+	live := map[revisionKey]bool{}
+	for k := range protect {
+		live[k] = true
+	}
+	for _, snap := range keep {
+		for _, f := range snap.Files {
+			live[revisionKey{f.FileID, f.RevisionID}] = true
+		}
+	}
+
+	var expired []revisionKey
+	seen := map[revisionKey]bool{}
+	for _, snap := range prune {
+		for _, f := range snap.Files {
+			k := revisionKey{f.FileID, f.RevisionID}
+			if f.RevisionID == "" || live[k] || seen[k] {
+				continue
+			}
+			seen[k] = true
+			expired = append(expired, k)
+		}
+	}
+
+	// In chunked mode a pack can go once no kept snapshot uses any chunk
+	// in it.
+	livePacks := map[string]bool{}
+	for _, snap := range keep {
+		for _, loc := range snap.Chunks {
+			livePacks[loc.Pack] = true
+		}
+	}
+	var expiredPacks []string
+	for _, snap := range prune {
+		for _, loc := range snap.Chunks {
+			if !livePacks[loc.Pack] {
+				livePacks[loc.Pack] = true
+				expiredPacks = append(expiredPacks, loc.Pack)
+			}
+		}
+	}
+
+	if dryRun {
+		for _, snap := range prune {
+			fmt.Printf("would remove snapshot %s (%d files)\n", snap.ID, len(snap.Files))
+		}
+		fmt.Printf("would delete %d revisions and %d packs, keep %d snapshots\n", len(expired), len(expiredPacks), len(keep))
+		return nil
+	}
+
+	var failed int
+	revs, _ := store.(revisionStore)
+	for _, k := range expired {
+		if revs == nil {
+			break
+		}
+		err := revs.DeleteRevision(k.FileID, k.RevisionID)
+		if err != nil && !isNotFound(err) && !isHeadRevisionError(err) {
+			log.Printf("Unable to delete revision %s of %s: %v", k.RevisionID, k.FileID, err)
+			failed++
+		}
+	}
+	for _, id := range expiredPacks {
+		if err := store.Delete(id, false); err != nil && !isNotFound(err) {
+			log.Printf("Unable to delete pack %s: %v", id, err)
+			failed++
+		}
+	}
+	for _, snap := range prune {
+		if err := store.Delete(byID[snap.ID].FileID, false); err != nil && !isNotFound(err) {
+			log.Printf("Unable to remove snapshot %s: %v", snap.ID, err)
+			failed++
+		}
+	}
+
+	log.Printf("Retention: removed %d snapshots, %d revisions and %d packs, kept %d snapshots",
+		len(prune), len(expired), len(expiredPacks), len(keep))
+	if failed > 0 {
+		return fmt.Errorf("%d items could not be pruned", failed)
+	}
+	return nil
+}
+
+// isHeadRevisionError reports whether a revision was not deleted because
+// it is the file's current content; that is expected when a file has not
+// changed since the pruned snapshot. Any other refusal is a real failure.
+func isHeadRevisionError(err error) bool {
+	return errors.Is(err, errHeadRevision)
+}
+
+// manifestRevisions returns the revisions the manifest currently points at.
+func manifestRevisions(m *manifest) map[revisionKey]bool {
+	revs := map[revisionKey]bool{}
+	for _, entry := range m.Files {
+		if entry.RevisionID != "" {
+			revs[revisionKey{entry.FileID, entry.RevisionID}] = true
+		}
+	}
+	return revs
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestSelectSnapshots(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+
+	// Oldest first; 2024-03-04 and -05 are in ISO week 10, 02-29 in week 9,
+	// 02-05 in week 6 and 01-31 in week 5.
+	times := []string{
+		"2024-01-15T12:00:00Z",
+		"2024-01-31T12:00:00Z",
+		"2024-02-05T12:00:00Z",
+		"2024-02-29T12:00:00Z",
+		"2024-03-04T09:00:00Z",
+		"2024-03-04T18:00:00Z",
+		"2024-03-05T12:00:00Z",
+	}
+	var snaps []*snapshot
+	for _, s := range times {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, &snapshot{ID: s[:13], Time: tm})
+	}
+
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		keep   []string
+	}{
+		{"no policy", retentionPolicy{}, []string{"2024-03-05T12", "2024-03-04T18", "2024-03-04T09", "2024-02-29T12", "2024-02-05T12", "2024-01-31T12", "2024-01-15T12"}},
+		{"last 2", retentionPolicy{Last: 2}, []string{"2024-03-05T12", "2024-03-04T18"}},
+		{"daily 1 keeps the newest", retentionPolicy{Daily: 1}, []string{"2024-03-05T12"}},
+		{"daily 2 keeps a day's newest", retentionPolicy{Daily: 2}, []string{"2024-03-05T12", "2024-03-04T18"}},
+		{"daily 3", retentionPolicy{Daily: 3}, []string{"2024-03-05T12", "2024-03-04T18", "2024-02-29T12"}},
+		{"weekly 3", retentionPolicy{Weekly: 3}, []string{"2024-03-05T12", "2024-02-29T12", "2024-02-05T12"}},
+		{"monthly 3", retentionPolicy{Monthly: 3}, []string{"2024-03-05T12", "2024-02-29T12", "2024-01-31T12"}},
+		{"more than there are", retentionPolicy{Monthly: 12}, []string{"2024-03-05T12", "2024-02-29T12", "2024-01-31T12"}},
+		{"rules combine", retentionPolicy{Last: 3, Monthly: 2}, []string{"2024-03-05T12", "2024-03-04T18", "2024-03-04T09", "2024-02-29T12"}},
+		{"daily and weekly", retentionPolicy{Daily: 2, Weekly: 2}, []string{"2024-03-05T12", "2024-03-04T18", "2024-02-29T12"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reverse the input to check the order is not relied on.
+			in := make([]*snapshot, len(snaps))
+			for i, s := range snaps {
+				in[len(snaps)-1-i] = s
+			}
+			keep, prune := selectSnapshots(in, tt.policy)
+			if got := snapshotIDs(keep); !reflect.DeepEqual(got, tt.keep) {
+				t.Errorf("keep = %v, want %v", got, tt.keep)
+			}
+			if len(keep)+len(prune) != len(snaps) {
+				t.Errorf("kept %d and pruned %d of %d snapshots", len(keep), len(prune), len(snaps))
+			}
+			for i := 1; i < len(prune); i++ {
+				if prune[i].Time.After(prune[i-1].Time) {
+					t.Errorf("prune not newest first: %v", snapshotIDs(prune))
+				}
+			}
+		})
+	}
+}
+
+func snapshotIDs(snaps []*snapshot) []string {
+	var ids []string
+	for _, s := range snaps {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestDriveDeleteRevision(t *testing.T) {
+	tests := []struct {
+		name       string
+		revision   string
+		getStatus  int
+		delStatus  int
+		delReason  string
+		wantDelete bool
+		wantErr    bool
+		wantHead   bool
+	}{
+		{name: "old revision", revision: "r1", getStatus: http.StatusOK, delStatus: http.StatusNoContent, wantDelete: true},
+		{name: "head revision", revision: "r2", getStatus: http.StatusOK, wantErr: true, wantHead: true},
+		{name: "rate limited", revision: "r1", getStatus: http.StatusOK, delStatus: http.StatusForbidden, delReason: "userRateLimitExceeded", wantDelete: true, wantErr: true},
+		{name: "bad request", revision: "r1", getStatus: http.StatusOK, delStatus: http.StatusBadRequest, delReason: "badRequest", wantDelete: true, wantErr: true},
+		{name: "no permission", revision: "r1", getStatus: http.StatusForbidden, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files/f1":
+					writeDriveResponse(w, tt.getStatus, "insufficientFilePermissions", `{"headRevisionId":"r2"}`)
+				case r.Method == http.MethodDelete && r.URL.Path == "/drive/v3/files/f1/revisions/"+tt.revision:
+					deleted = true
+					writeDriveResponse(w, tt.delStatus, tt.delReason, "")
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+
+			d := newTestDriveBackend(t, srv)
+			err := d.DeleteRevision("f1", tt.revision)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteRevision = %v, want error %v", err, tt.wantErr)
+			}
+			if got := isHeadRevisionError(err); got != tt.wantHead {
+				t.Errorf("isHeadRevisionError(%v) = %v, want %v", err, got, tt.wantHead)
+			}
+			if deleted != tt.wantDelete {
+				t.Errorf("revision deleted = %v, want %v", deleted, tt.wantDelete)
+			}
+		})
+	}
+}
+
+func writeDriveResponse(w http.ResponseWriter, status int, reason, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status >= 400 {
+		body = fmt.Sprintf(`{"error":{"code":%d,"message":"refused","errors":[{"reason":%q}]}}`, status, reason)
+	}
+	io.WriteString(w, body)
+}
+
+func newTestDriveBackend(t *testing.T, srv *httptest.Server) *driveBackend {
+	t.Helper()
+	s, err := drive.NewService(context.Background(), option.WithEndpoint(srv.URL+"/drive/v3/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newDriveBackend(srv.Client(), s)
+}
+
+// failingRevisions is a local backend whose revisions cannot be deleted.
+type failingRevisions struct {
+	*localBackend
+	err     error
+	deletes int
+}
+
+func (f *failingRevisions) PinRevision(fileID, revisionID string) error { return nil }
+
+func (f *failingRevisions) DownloadRevision(fileID, revisionID string) (io.ReadCloser, error) {
+	return f.Download(fileID)
+}
+
+func (f *failingRevisions) DeleteRevision(fileID, revisionID string) error {
+	f.deletes++
+	return f.err
+}
+
+func TestPruneReportsRevisionFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"deleted", nil, false},
+		{"head revision", errHeadRevision, false},
+		{"gone", errNotFound, false},
+		{"quota", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}}}, true},
+		{"rate limit", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{"bad request", &googleapi.Error{Code: http.StatusBadRequest}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, err := newLocalBackend(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &failingRevisions{localBackend: local, err: tt.err}
+			rootID, err := store.Mkdir(rootFolderID, "backup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			putSnapshot(t, store, rootID, &snapshot{ID: newSnapshotID(old), Time: old, Files: map[string]*snapshotFile{
+				"a.txt": {FileID: "f1", RevisionID: "r1"},
+			}})
+			putSnapshot(t, store, rootID, &snapshot{ID: newSnapshotID(old.Add(time.Hour)), Time: old.Add(time.Hour), Files: map[string]*snapshotFile{
+				"a.txt": {FileID: "f1", RevisionID: "r2"},
+			}})
+
+			err = pruneSnapshots(store, nil, rootID, retentionPolicy{Last: 1}, nil, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pruneSnapshots = %v, want error %v", err, tt.wantErr)
+			}
+			if store.deletes != 1 {
+				t.Errorf("%d revisions deleted, want 1", store.deletes)
+			}
+		})
+	}
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the part size for multipart uploads; payloads up to
+	// s3MultipartThreshold go up in a single PUT.
+	s3PartSize           = 16 << 20
+	s3MultipartThreshold = 64 << 20
+
+	// s3ResponseTimeout bounds how long a request waits for the response
+	// headers once it has been sent, so a stalled endpoint fails the run
+	// instead of hanging it. Bodies of any size can still take their time.
+	s3ResponseTimeout = 2 * time.Minute
+
+	// s3MtimeHeader carries the local modification time, since S3 only
+	// records when an object was written.
+	s3MtimeHeader = "X-Amz-Meta-Mtime"
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// A single CopyObject request copies at most s3CopyLimit bytes; larger
+// objects are copied in s3CopyPartSize parts of a multipart upload. They
+// are variables so tests can copy in parts without 5 GiB objects.
+var (
+	s3CopyLimit    int64 = 5 << 30
+	s3CopyPartSize int64 = 1 << 30
+)
+
+// s3Config describes an S3-compatible bucket such as AWS S3 or MinIO. In the
+// cluster it comes from the s3-credentials Secret, one file per field.
+type s3Config struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// loadS3Config reads the fields present in dir. Missing files are left
+// empty so flags or the environment can fill them in.
+func loadS3Config(dir string) (s3Config, error) {
+	var cfg s3Config
+	fields := map[string]*string{
+		"endpoint":          &cfg.Endpoint,
+		"bucket":            &cfg.Bucket,
+		"prefix":            &cfg.Prefix,
+		"region":            &cfg.Region,
+		"access-key-id":     &cfg.AccessKey,
+		"secret-access-key": &cfg.SecretKey,
+	}
+	for name, field := range fields {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cfg, err
+		}
+		*field = strings.TrimSpace(string(b))
+	}
+	return cfg, nil
+}
+
+func (c s3Config) validate() error {
+	var missing []string
+	if c.Endpoint == "" {
+		missing = append(missing, "endpoint")
+	}
+	if c.Bucket == "" {
+		missing = append(missing, "bucket")
+	}
+	if c.AccessKey == "" {
+		missing = append(missing, "access key")
+	}
+	if c.SecretKey == "" {
+		missing = append(missing, "secret key")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("S3 backend is missing %s", strings.Join(missing, ", "))
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		return fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	return nil
+}
+
+// s3Backend stores backups as objects in an S3-compatible bucket. It uses
+// path-style requests signed with AWS Signature Version 4, which AWS and
+// MinIO both accept.
+//
+// Object IDs are keys relative to the configured prefix. S3 has no folders,
+// so a folder is a key prefix ending in "/" together with an empty marker
+// object of that name, which keeps empty folders visible.
+type s3Backend struct {
+	cfg      s3Config
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+}
+
+func newS3Backend(cfg s3Config) (*s3Backend, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	endpoint, _ := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: want a URL such as https://minio.example:9000", cfg.Endpoint)
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s3ResponseTimeout
+	return &s3Backend{cfg: cfg, endpoint: endpoint, prefix: prefix, client: &http.Client{Transport: transport}}, nil
+}
+
+// key maps an object ID to its full key in the bucket.
+func (s *s3Backend) key(id string) string {
+	if id == rootFolderID {
+		return strings.TrimSuffix(s.prefix, "/")
+	}
+	return s.prefix + id
+}
+
+// dirKey is the prefix that everything inside folder id shares.
+func (s *s3Backend) dirKey(id string) string {
+	if id == rootFolderID {
+		return s.prefix
+	}
+	return s.prefix + id + "/"
+}
+
+func (s *s3Backend) child(parentID, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	if parentID == rootFolderID {
+		return name, nil
+	}
+	return parentID + "/" + name, nil
+}
+
+func (s *s3Backend) Stat(parentID, name string, folder bool) (*object, error) {
+	id, err := s.child(parentID, name)
+	if err != nil {
+		return nil, err
+	}
+	if folder {
+		page, err := s.listPage(s.dirKey(id), "/", "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Contents) == 0 && len(page.CommonPrefixes) == 0 {
+			return nil, nil
+		}
+		return &object{ID: id, Name: name, Folder: true}, nil
+	}
+
+	res, err := s.do(http.MethodHead, s.key(id), nil, nil, nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return s.headObject(id, res), nil
+}
+
+func (s *s3Backend) headObject(id string, res *http.Response) *object {
+	o := &object{
+		ID:   id,
+		Name: path.Base(id),
+		Size: res.ContentLength,
+		MD5:  etagMD5(res.Header.Get("ETag")),
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		o.ModTime = t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, res.Header.Get(s3MtimeHeader)); err == nil {
+		o.ModTime = t
+	}
+	return o
+}
+
+// List returns the objects and folders directly inside folderID. Listings
+// do not include user metadata, so ModTime is when the object was written.
+func (s *s3Backend) List(folderID string) ([]*object, error) {
+	dir := s.dirKey(folderID)
+	var objects []*object
+	token := ""
+	for {
+		page, err := s.listPage(dir, "/", token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, dir), "/")
+			if name == "" || (folderID == rootFolderID && name == localTrashDir) {
+				continue
+			}
+			id, _ := s.child(folderID, name)
+			objects = append(objects, &object{ID: id, Name: name, Folder: true})
+		}
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, dir)
+			if name == "" {
+				continue // the folder's own marker
+			}
+			id, _ := s.child(folderID, name)
+			objects = append(objects, &object{
+				ID:      id,
+				Name:    name,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+				MD5:     etagMD5(c.ETag),
+			})
+		}
+		if !page.IsTruncated {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3Backend) Mkdir(parentID, name string) (string, error) {
+	id, err := s.child(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	res, err := s.do(http.MethodPut, s.dirKey(id), nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return id, nil
+}
+
+// Upload spools media to a temporary file first, because S3 needs the
+// length and hash of a payload before accepting it.
+func (s *s3Backend) Upload(parentID, name, fileID string, media io.Reader, modTime time.Time) (*object, error) {
+	id := fileID
+	if id == "" {
+		var err error
+		if id, err = s.child(parentID, name); err != nil {
+			return nil, err
+		}
+	} else {
+		// A PUT would quietly recreate the object, so check it is still
+		// there as the Backend contract requires.
+		res, err := s.do(http.MethodHead, s.key(id), nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		res.Body.Close()
+	}
+
+	tmp, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sha := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sha), media)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set(s3MtimeHeader, driveTime(modTime))
+	var etag string
+	if size > s3MultipartThreshold {
+		etag, err = s.multipartUpload(s.key(id), tmp, size, header)
+	} else {
+		var res *http.Response
+		res, err = s.do(http.MethodPut, s.key(id), nil, header, &s3Payload{
+			body: io.NewSectionReader(tmp, 0, size),
+			size: size,
+			hash: hex.EncodeToString(sha.Sum(nil)),
+		})
+		if err == nil {
+			res.Body.Close()
+			etag = res.Header.Get("ETag")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &object{ID: id, Name: path.Base(id), Size: size, ModTime: modTime, MD5: etagMD5(etag)}, nil
+}
+
+// multipartUpload sends the payload in s3PartSize parts. The resulting ETag
+// is not an MD5, so the caller's checksum comparison is skipped.
+func (s *s3Backend) multipartUpload(key string, f *os.File, size int64, header http.Header) (string, error) {
+	uploadID, err := s.startMultipart(key, header)
+	if err != nil {
+		return "", err
+	}
+	var parts []s3Part
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+s3PartSize, n+1 {
+		length := size - offset
+		if length > s3PartSize {
+			length = s3PartSize
+		}
+		sha := sha256.New()
+		if _, err := io.Copy(sha, io.NewSectionReader(f, offset, length)); err != nil {
+			s.abortMultipart(key, uploadID)
+			return "", err
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		res, err := s.do(http.MethodPut, key, query, nil, &s3Payload{
+			body: io.NewSectionReader(f, offset, length),
+			size: length,
+			hash: hex.EncodeToString(sha.Sum(nil)),
+		})
+		if err != nil {
+			s.abortMultipart(key, uploadID)
+			return "", err
+		}
+		res.Body.Close()
+		parts = append(parts, s3Part{Number: n, ETag: res.Header.Get("ETag")})
+	}
+	return s.completeMultipart(key, uploadID, parts)
+}
+
+// s3Part is a finished part of a multipart upload.
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// startMultipart initiates a multipart upload to key, which gets the
+// metadata in header, and returns its upload ID.
+func (s *s3Backend) startMultipart(key string, header http.Header) (string, error) {
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, &initiated); err != nil {
+		return "", err
+	}
+	return initiated.UploadID, nil
+}
+
+func (s *s3Backend) abortMultipart(key, uploadID string) {
+	if res, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err == nil {
+		res.Body.Close()
+	}
+}
+
+// completeMultipart assembles parts into the object at key and returns its
+// ETag, aborting the upload if that fails.
+func (s *s3Backend) completeMultipart(key, uploadID string, parts []s3Part) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return "", err
+	}
+	var completed struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	query := url.Values{"uploadId": {uploadID}}
+	if err := s.doXML(http.MethodPost, key, query, nil, newS3Payload(body), &completed); err != nil {
+		s.abortMultipart(key, uploadID)
+		return "", err
+	}
+	if completed.XMLName.Local == "Error" {
+		s.abortMultipart(key, uploadID)
+		return "", &s3Error{Status: http.StatusInternalServerError, Code: completed.Code, Message: completed.Message}
+	}
+	return completed.ETag, nil
+}
+
+// Move copies the object to its new key and deletes the old one; S3 cannot
+// rename in place. The returned ID is the new key.
+func (s *s3Backend) Move(id, oldParentID, newParentID, name string) (string, error) {
+	newID, err := s.child(newParentID, name)
+	if err != nil {
+		return "", err
+	}
+	if err := s.copyObject(s.key(id), s.key(newID)); err != nil {
+		return "", err
+	}
+	res, err := s.do(http.MethodDelete, s.key(id), nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return newID, nil
+}
+
+// copyObject copies the object at from to the key to, keeping its
+// metadata. Objects over s3CopyLimit are copied part by part.
+func (s *s3Backend) copyObject(from, to string) error {
+	res, err := s.do(http.MethodHead, from, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	source := "/" + s.cfg.Bucket + "/" + s3Escape(from, false)
+	if res.ContentLength > s3CopyLimit {
+		header := http.Header{}
+		if mtime := res.Header.Get(s3MtimeHeader); mtime != "" {
+			header.Set(s3MtimeHeader, mtime)
+		}
+		return s.multipartCopy(source, to, res.ContentLength, header)
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", source)
+	_, err = s.copyRequest(to, nil, header)
+	return err
+}
+
+// multipartCopy copies the size bytes of source to key with UploadPartCopy
+// requests of s3CopyPartSize bytes each.
+func (s *s3Backend) multipartCopy(source, key string, size int64, header http.Header) error {
+	uploadID, err := s.startMultipart(key, header)
+	if err != nil {
+		return err
+	}
+	var parts []s3Part
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+s3CopyPartSize, n+1 {
+		end := offset + s3CopyPartSize
+		if end > size {
+			end = size
+		}
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", source)
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		etag, err := s.copyRequest(key, query, header)
+		if err != nil {
+			s.abortMultipart(key, uploadID)
+			return err
+		}
+		parts = append(parts, s3Part{Number: n, ETag: etag})
+	}
+	_, err = s.completeMultipart(key, uploadID, parts)
+	return err
+}
+
+// copyRequest sends a CopyObject or UploadPartCopy request and returns the
+// ETag of what it copied.
+func (s *s3Backend) copyRequest(key string, query url.Values, header http.Header) (string, error) {
+	// A copy can fail after the 200 status line has been sent, so the
+	// body has to be checked for an error document too.
+	var result struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := s.doXML(http.MethodPut, key, query, header, nil, &result); err != nil {
+		return "", err
+	}
+	if result.XMLName.Local == "Error" {
+		return "", &s3Error{Status: http.StatusInternalServerError, Code: result.Code, Message: result.Message}
+	}
+	return result.ETag, nil
+}
+
+func (s *s3Backend) Download(id string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, s.key(id), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3Backend) DownloadRange(id string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	res, err := s.do(http.MethodGet, s.key(id), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Delete removes the object id, or everything in it if it is a folder.
+// There is no trash in S3, so trashed objects are moved under .trash with
+// a timestamp, mirroring the local backend.
+func (s *s3Backend) Delete(id string, trash bool) error {
+	keys, err := s.listAll(s.dirKey(id))
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		res, err := s.do(http.MethodHead, s.key(id), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		keys = []string{s.key(id)}
+	}
+
+	stamp := time.Now().UTC().Format(snapshotIDLayout)
+	for _, key := range keys {
+		if trash {
+			rel := strings.TrimPrefix(key, s.prefix)
+			dest := s.prefix + localTrashDir + "/" + stamp + "/" + rel
+			if err := s.copyObject(key, dest); err != nil {
+				return err
+			}
+		}
+		res, err := s.do(http.MethodDelete, key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+	return nil
+}
+
+// listAll returns every key under prefix, at any depth.
+func (s *s3Backend) listAll(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		page, err := s.listPage(prefix, "", token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !page.IsTruncated {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+func (s *s3Backend) listPage(prefix, delimiter, token string, max int) (*s3ListResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(max)},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	page := &s3ListResult{}
+	if err := s.doXML(http.MethodGet, "", query, nil, nil, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// s3Payload is a request body together with the length and SHA-256 that
+// have to be signed along with it.
+type s3Payload struct {
+	body io.Reader
+	size int64
+	hash string
+}
+
+func newS3Payload(b []byte) *s3Payload {
+	sum := sha256.Sum256(b)
+	return &s3Payload{body: bytes.NewReader(b), size: int64(len(b)), hash: hex.EncodeToString(sum[:])}
+}
+
+// s3Error is an error response from the S3 API.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s", http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (e *s3Error) Unwrap() error {
+	if e.Status == http.StatusNotFound {
+		return errNotFound
+	}
+	return nil
+}
+
+// do sends a signed request for key, which is empty for bucket-level
+// requests, and turns non-2xx responses into an *s3Error.
+func (s *s3Backend) do(method, key string, query url.Values, header http.Header, payload *s3Payload) (*http.Response, error) {
+	if payload == nil {
+		payload = &s3Payload{hash: emptySHA256}
+	}
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.cfg.Bucket
+	u.RawPath = s.endpoint.Path + "/" + s3Escape(s.cfg.Bucket, true)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, false)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), payload.body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = payload.size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, payload.hash, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	var doc struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	xml.Unmarshal(body, &doc)
+	return nil, &s3Error{Status: res.StatusCode, Code: doc.Code, Message: doc.Message}
+}
+
+func (s *s3Backend) doXML(method, key string, query url.Values, header http.Header, payload *s3Payload, v interface{}) error {
+	res, err := s.do(method, key, query, header, payload)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			signed[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, part := range []string{day, s.cfg.Region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// s3CanonicalQuery encodes query sorted by key as SigV4 requires.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and also
+// keeps slashes unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// etagMD5 returns the MD5 an ETag carries, or "" for multipart and
+// encrypted objects whose ETag is something else.
+func etagMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 2*md5.Size {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+	return strings.ToLower(etag)
+}
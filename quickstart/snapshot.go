@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotsFolderName is the folder inside the backup root holding one JSON
+// index per backup run. Restores and tree listings skip it.
+const snapshotsFolderName = ".drive-backup-snapshots"
+
+const snapshotIDLayout = "20060102T150405Z"
+
+// snapshotFile pins one file of a snapshot to a specific revision.
+type snapshotFile struct {
+	FileID     string    `json:"fileId"`
+	RevisionID string    `json:"revisionId,omitempty"`
+	MD5        string    `json:"md5"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	// Chunks lists the file's content in chunked storage mode.
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// snapshot records the state of the backup folder as of one run.
+type snapshot struct {
+	ID    string                   `json:"id"`
+	Time  time.Time                `json:"time"`
+	Files map[string]*snapshotFile `json:"files"`
+	// Chunks locates every chunk the files reference, so a chunked
+	// snapshot can be restored from the backend alone.
+	Chunks map[string]chunkLocation `json:"chunks,omitempty"`
+}
+
+// snapshotInfo is a snapshot index found in the backend, without its file list.
+type snapshotInfo struct {
+	ID     string
+	FileID string
+	Size   int64
+}
+
+func newSnapshotID(t time.Time) string {
+	return t.UTC().Format(snapshotIDLayout)
+}
+
+// recordSnapshot writes an index of every file the manifest currently
+// tracks, with the revision each one was at, to the snapshots folder.
+func (r *backupRun) recordSnapshot(now time.Time) (*snapshot, error) {
+	snap := &snapshot{
+		ID:    newSnapshotID(now),
+		Time:  now.UTC(),
+		Files: map[string]*snapshotFile{},
+	}
+	for rel, entry := range r.manifest.Files {
+		if entry.DeletedAt != nil {
+			continue
+		}
+		snap.Files[rel] = &snapshotFile{
+			FileID:     entry.FileID,
+			RevisionID: entry.RevisionID,
+			MD5:        entry.MD5,
+			Size:       entry.Size,
+			ModTime:    entry.ModTime,
+			Chunks:     entry.Chunks,
+		}
+		for _, id := range entry.Chunks {
+			if snap.Chunks == nil {
+				snap.Chunks = map[string]chunkLocation{}
+			}
+			snap.Chunks[id] = r.manifest.Chunks[id]
+		}
+	}
+
+	folderID, err := r.store.Mkdir(r.manifest.RootID, snapshotsFolderName)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// The index lists every path, so it is encrypted like the files are.
+	if body, err = r.opts.Crypt.sealBytes(body); err != nil {
+		return nil, err
+	}
+	if _, err := r.store.Upload(folderID, snap.ID+".json", "", bytes.NewReader(body), snap.Time); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// listSnapshots returns the snapshots stored under the backup root, oldest
+// first.
+func listSnapshots(store Backend, rootID string) ([]snapshotInfo, error) {
+	folder, err := store.Stat(rootID, snapshotsFolderName, true)
+	if err != nil || folder == nil {
+		return nil, err
+	}
+
+	objects, err := store.List(folder.ID)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshotInfo
+	for _, o := range objects {
+		if o.Folder || !strings.HasSuffix(o.Name, ".json") {
+			continue
+		}
+		snaps = append(snaps, snapshotInfo{
+			ID:     strings.TrimSuffix(o.Name, ".json"),
+			FileID: o.ID,
+			Size:   o.Size,
+		})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].ID < snaps[j].ID })
+	return snaps, nil
+}
+
+// snapshotFileIDs returns the IDs of the mirrored files the snapshots under
+// rootID restore from.
+func snapshotFileIDs(store Backend, c *crypter, rootID string) (map[string]bool, error) {
+	infos, err := listSnapshots(store, rootID)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, info := range infos {
+		snap, err := downloadSnapshot(store, c, info)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range snap.Files {
+			if f.FileID != "" {
+				ids[f.FileID] = true
+			}
+		}
+	}
+	return ids, nil
+}
+
+// loadSnapshot fetches the snapshot index with the given ID; "latest"
+// selects the most recent one.
+func loadSnapshot(store Backend, c *crypter, rootID, id string) (*snapshot, error) {
+	snaps, err := listSnapshots(store, rootID)
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, fmt.Errorf("no snapshots recorded yet")
+	}
+
+	var info *snapshotInfo
+	if id == "latest" {
+		info = &snaps[len(snaps)-1]
+	} else {
+		for i := range snaps {
+			if snaps[i].ID == id {
+				info = &snaps[i]
+				break
+			}
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("snapshot %q not found", id)
+	}
+	return downloadSnapshot(store, c, *info)
+}
+
+// downloadSnapshot fetches and parses a snapshot index, decrypting it when
+// the backup is encrypted.
+func downloadSnapshot(store Backend, c *crypter, info snapshotInfo) (*snapshot, error) {
+	rc, err := store.Download(info.FileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	body, err := c.openReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{}
+	if err := json.NewDecoder(body).Decode(snap); err != nil {
+		return nil, fmt.Errorf("unable to parse snapshot %s: %v", info.ID, err)
+	}
+	return snap, nil
+}
+
+// printSnapshots writes a table of the snapshots under the backup folder.
+func printSnapshots(store Backend, c *crypter, folder string) error {
+	root, err := store.Stat(rootFolderID, folder, true)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return fmt.Errorf("backup folder %q not found", folder)
+	}
+
+	snaps, err := listSnapshots(store, root.ID)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		fmt.Println("No snapshots recorded yet.")
+		return nil
+	}
+
+	fmt.Printf("%-18s  %-20s  %6s  %12s\n", "ID", "TIME", "FILES", "BYTES")
+	for _, info := range snaps {
+		snap, err := downloadSnapshot(store, c, info)
+		if err != nil {
+			log.Printf("Unable to read snapshot %s: %v", info.ID, err)
+			continue
+		}
+		var total int64
+		for _, f := range snap.Files {
+			total += f.Size
+		}
+		fmt.Printf("%-18s  %-20s  %6d  %12d\n", snap.ID, snap.Time.Local().Format("2006-01-02 15:04:05"), len(snap.Files), total)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// resumableChunkSize must be a multiple of 256 KiB per the Drive API.
+	resumableChunkSize = 8 << 20
+	// Drive keeps resumable sessions for a week; give up on them a little
+	// earlier so we never send a chunk into an expired session.
+	resumableSessionTTL = 6 * 24 * time.Hour
+)
+
+// errSessionExpired is returned when Drive no longer knows an upload session.
+var errSessionExpired = errors.New("upload session expired")
+
+// uploadSession is the persisted state of an interrupted resumable upload.
+type uploadSession struct {
+	URI    string `json:"uri"`
+	Offset int64  `json:"offset"`
+	// Total is the payload length, which differs from Size when the
+	// file is encrypted; Salt reproduces the same ciphertext on resume
+	// and PayloadMD5 is the checksum of that ciphertext.
+	Total      int64     `json:"total"`
+	Salt       []byte    `json:"salt,omitempty"`
+	PayloadMD5 string    `json:"payloadMd5,omitempty"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	MD5        string    `json:"md5"`
+	ParentID   string    `json:"parentId"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+// matches reports whether the session was started for exactly this version
+// of the local file and is still young enough to resume.
+func (s *uploadSession) matches(info os.FileInfo, sum, parentID string, encrypted bool, now time.Time) bool {
+	return s.Total > 0 && (len(s.Salt) > 0) == encrypted && (len(s.Salt) > 0) == (s.PayloadMD5 != "") && s.Size == info.Size() && s.ModTime.Equal(info.ModTime()) && s.MD5 == sum &&
+		s.ParentID == parentID && now.Sub(s.StartedAt) < resumableSessionTTL
+}
+
+// resumableUpload uploads a large file using Drive's resumable protocol. The
+// session URI and confirmed byte offset are checkpointed into the manifest
+// after every chunk, so a run that is killed part way through picks up where
+// it left off next time instead of starting over.
+func (r *backupRun) resumableUpload(d *driveBackend, rel, local, name, parentID, fileID, sum string) (*object, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := r.manifest.Uploads[rel]
+	if s != nil && !s.matches(info, sum, parentID, r.opts.Crypt != nil, now) {
+		s = nil
+	}
+
+	if s != nil {
+		offset, done, err := d.queryUploadOffset(s)
+		switch {
+		case errors.Is(err, errSessionExpired):
+			log.Printf("Upload session for %s expired; starting over", rel)
+			s = nil
+		case err != nil:
+			return nil, err
+		case done != nil:
+			delete(r.manifest.Uploads, rel)
+			return driveObject(done), verifyResumable(s, done)
+		default:
+			log.Printf("Resuming upload of %s at byte %d of %d", rel, offset, s.Total)
+			s.Offset = offset
+		}
+	}
+
+	if s == nil {
+		if fileID == "" {
+			existing, err := d.Stat(parentID, name, false)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				fileID = existing.ID
+			}
+		}
+		var salt []byte
+		var payloadSum string
+		if r.opts.Crypt != nil {
+			if salt, err = newSalt(); err != nil {
+				return nil, err
+			}
+			if payloadSum, err = r.payloadMD5(local, salt); err != nil {
+				return nil, err
+			}
+		}
+		total := r.payloadSize(info.Size())
+		uri, err := d.startUploadSession(name, parentID, fileID, info.ModTime(), total)
+		if err != nil {
+			return nil, err
+		}
+		s = &uploadSession{
+			URI:        uri,
+			Total:      total,
+			Salt:       salt,
+			PayloadMD5: payloadSum,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			MD5:        sum,
+			ParentID:   parentID,
+			StartedAt:  now,
+		}
+		r.manifest.Uploads[rel] = s
+		r.checkpoint()
+	}
+
+	payload, closer, err := r.openPayload(local, s.Salt, s.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { closer.Close() }()
+
+	buf := make([]byte, resumableChunkSize)
+	for {
+		n := s.Total - s.Offset
+		if n > resumableChunkSize {
+			n = resumableChunkSize
+		}
+		if _, err := io.ReadFull(payload, buf[:n]); err != nil {
+			return nil, err
+		}
+		offset, done, err := d.sendChunk(s, bytes.NewReader(buf[:n]), n)
+		if errors.Is(err, errSessionExpired) {
+			delete(r.manifest.Uploads, rel)
+			r.checkpoint()
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if done != nil {
+			delete(r.manifest.Uploads, rel)
+			return driveObject(done), verifyResumable(s, done)
+		}
+
+		// Drive may keep less than a full chunk; reposition the payload
+		// at whatever it acknowledged.
+		if offset != s.Offset+n {
+			closer.Close()
+			if payload, closer, err = r.openPayload(local, s.Salt, offset); err != nil {
+				return nil, err
+			}
+		}
+		s.Offset = offset
+		r.checkpoint()
+	}
+}
+
+// verifyResumable compares the size and checksum Drive reports for a
+// finished resumable upload with the payload the session was started for:
+// the local file, or its ciphertext when the file is encrypted.
+func verifyResumable(s *uploadSession, f *drive.File) error {
+	want := s.MD5
+	if len(s.Salt) > 0 {
+		want = s.PayloadMD5
+	}
+	if f.Size != 0 && f.Size != s.Total {
+		return fmt.Errorf("size mismatch after upload: sent %d bytes, drive has %d", s.Total, f.Size)
+	}
+	if f.Md5Checksum == "" || f.Md5Checksum == want {
+		return nil
+	}
+	return fmt.Errorf("checksum mismatch after upload: local %s, drive %s", want, f.Md5Checksum)
+}
+
+// payloadMD5 returns the checksum of the ciphertext local encrypts to with
+// salt, so a resumed upload can be checked as a whole once it finishes.
+func (r *backupRun) payloadMD5(local string, salt []byte) (string, error) {
+	payload, closer, err := r.openPayload(local, salt, 0)
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, payload); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadBaseURL returns the media upload endpoint matching the service.
+func (d *driveBackend) uploadBaseURL() string {
+	return strings.Replace(d.srv.BasePath, "/drive/v3/", "/upload/drive/v3/", 1)
+}
+
+// startUploadSession opens a resumable upload session, either for a new file
+// in parentID or a new revision of fileID, and returns the session URI.
+func (d *driveBackend) startUploadSession(name, parentID, fileID string, modTime time.Time, total int64) (string, error) {
+	method := http.MethodPost
+	target := d.uploadBaseURL() + "files"
+	meta := &drive.File{Name: name, Parents: []string{d.folder(parentID)}, ModifiedTime: driveTime(modTime)}
+	if fileID != "" {
+		method = http.MethodPatch
+		target += "/" + url.PathEscape(fileID)
+		meta = &drive.File{ModifiedTime: driveTime(modTime)}
+	}
+	target += "?uploadType=resumable&supportsAllDrives=true&fields=" + url.QueryEscape(driveFileFields)
+
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(total, 10))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", uploadError(res)
+	}
+	uri := res.Header.Get("Location")
+	if uri == "" {
+		return "", errors.New("drive did not return an upload session URI")
+	}
+	return uri, nil
+}
+
+// queryUploadOffset asks Drive how many bytes of the session it has stored.
+// If the upload had in fact completed, the resulting file is returned.
+func (d *driveBackend) queryUploadOffset(s *uploadSession) (int64, *drive.File, error) {
+	req, err := http.NewRequest(http.MethodPut, s.URI, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", s.Total))
+	return d.doUploadRequest(req)
+}
+
+// sendChunk uploads n bytes of chunk starting at the session's offset.
+func (d *driveBackend) sendChunk(s *uploadSession, chunk io.Reader, n int64) (int64, *drive.File, error) {
+	req, err := http.NewRequest(http.MethodPut, s.URI, chunk)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.ContentLength = n
+	if n == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", s.Total))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", s.Offset, s.Offset+n-1, s.Total))
+	}
+	return d.doUploadRequest(req)
+}
+
+// doUploadRequest sends a request against a session URI and interprets the
+// response: 308 carries the next offset, 200/201 the finished file.
+func (d *driveBackend) doUploadRequest(req *http.Request) (int64, *drive.File, error) {
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPermanentRedirect:
+		return parseRangeHeader(res.Header.Get("Range")), nil, nil
+	case http.StatusOK, http.StatusCreated:
+		f := &drive.File{}
+		if err := json.NewDecoder(res.Body).Decode(f); err != nil {
+			return 0, nil, err
+		}
+		return 0, f, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, nil, errSessionExpired
+	}
+	return 0, nil, uploadError(res)
+}
+
+// parseRangeHeader turns a "bytes=0-N" Range header into the next offset.
+// A missing header means Drive has not stored anything yet.
+func parseRangeHeader(h string) int64 {
+	i := strings.LastIndex(h, "-")
+	if i < 0 {
+		return 0
+	}
+	end, err := strconv.ParseInt(h[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return end + 1
+}
+
+func uploadError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return fmt.Errorf("upload request failed: %s: %s", res.Status, strings.TrimSpace(string(body)))
+}
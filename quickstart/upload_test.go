@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestVerifyResumable(t *testing.T) {
+	c := testCrypter(t)
+	local := filepath.Join(t.TempDir(), "video.mp4")
+	content := bytes.Repeat([]byte("frame"), 1000)
+	if err := os.WriteFile(local, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(content)
+	plainMD5 := hex.EncodeToString(sum[:])
+
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &backupRun{opts: backupOptions{Crypt: c}}
+	payloadSum, err := r.payloadMD5(local, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checksum is of the same ciphertext a resumed upload sends.
+	payload, closer, err := r.openPayload(local, salt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(payload)
+	closer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md5.Sum(ciphertext); hex.EncodeToString(got[:]) != payloadSum {
+		t.Fatalf("payloadMD5 = %s, want the checksum of the ciphertext", payloadSum)
+	}
+
+	plain := &uploadSession{Total: int64(len(content)), MD5: plainMD5}
+	encrypted := &uploadSession{Total: int64(len(ciphertext)), Salt: salt, PayloadMD5: payloadSum, MD5: plainMD5}
+	tests := []struct {
+		name    string
+		s       *uploadSession
+		f       *drive.File
+		wantErr bool
+	}{
+		{"plaintext", plain, &drive.File{Size: plain.Total, Md5Checksum: plainMD5}, false},
+		{"plaintext corrupted", plain, &drive.File{Size: plain.Total, Md5Checksum: payloadSum}, true},
+		{"plaintext truncated", plain, &drive.File{Size: plain.Total - 1, Md5Checksum: plainMD5}, true},
+		{"encrypted", encrypted, &drive.File{Size: encrypted.Total, Md5Checksum: payloadSum}, false},
+		{"encrypted corrupted", encrypted, &drive.File{Size: encrypted.Total, Md5Checksum: plainMD5}, true},
+		{"encrypted truncated", encrypted, &drive.File{Size: encrypted.Total - 1, Md5Checksum: payloadSum}, true},
+		{"no checksum reported", encrypted, &drive.File{}, false},
+	}
+	for _, tt := range tests {
+		if err := verifyResumable(tt.s, tt.f); (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyResumable = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// TestUploadSessionMatches checks encrypted sessions recorded without the
+// ciphertext checksum start over instead of resuming unverified.
+func TestUploadSessionMatches(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(local, []byte("frames"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := info.ModTime()
+	s := uploadSession{Total: 100, Salt: []byte("salt"), PayloadMD5: "ab", Size: info.Size(), ModTime: info.ModTime(), MD5: "cd", ParentID: "p", StartedAt: now}
+	if !s.matches(info, "cd", "p", true, now) {
+		t.Error("session does not match the file it was started for")
+	}
+	if s.matches(info, "cd", "p", false, now) {
+		t.Error("encrypted session matches a plaintext upload")
+	}
+	s.PayloadMD5 = ""
+	if s.matches(info, "cd", "p", true, now) {
+		t.Error("encrypted session without a ciphertext checksum matches")
+	}
+}
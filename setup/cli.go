@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"backupjob"
+)
+
+// commands are setup's subcommands, in the order usage lists them.
+var commands = []struct {
+	Name, Summary string
+	Main          func(fs *flag.FlagSet, args []string)
+}{
+	{"login", "log in to Google Drive and store the credentials in the cluster", loginMain},
+	{"logout", "revoke the login and remove the token from the cluster", logoutMain},
+	{"apply", "create or update the backup job", applyMain},
+	{"status", "show the job's schedule, recent runs and login", statusMain},
+	{"run", "start a backup now", runMain},
+	{"restore", "restore files into the backed-up folder", restoreMain},
+	{"snapshots", "list the backup's snapshots", snapshotsMain},
+	{"stop", "remove the backup job from the cluster", stopMain},
+	{"export", "write the job as a Helm chart or kustomize base for GitOps tools such as Argo CD", exportMain},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintln(w, "Usage: setup <command> [flags]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintln(w, "\nRun \"setup <command> -h\" for a command's flags, or setup without a command")
+	fmt.Fprintln(w, "to be asked for the settings.")
+}
+
+// commandMain runs the subcommand name. Every command takes the flags that
+// pick the job and cluster.
+func commandMain(name string, args []string) {
+	for _, c := range commands {
+		if c.Name == name {
+			fs := flag.NewFlagSet(name, flag.ExitOnError)
+			fs.Usage = func() {
+				fmt.Fprintf(fs.Output(), "Usage: setup %s [flags]\n\nTo %s.\n\nFlags:\n", c.Name, c.Summary)
+				fs.PrintDefaults()
+			}
+			addJobFlags(fs)
+			c.Main(fs, args)
+			return
+		}
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "setup: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// addJobFlags registers the flags selecting the job on fs.
+func addJobFlags(fs *flag.FlagSet) {
+	fs.StringVar(&job.Name, "job", backupjob.DefaultName, "name of the backup job; give each job on a cluster its own")
+	fs.StringVar(&job.Namespace, "namespace", "", "namespace for the job (default the kubeconfig context's namespace)")
+	fs.StringVar(&job.Context, "context", "", "kubeconfig context to use (default the current context)")
+}
+
+// addLoginFlag registers -login on fs; setLogin applies it.
+func addLoginFlag(fs *flag.FlagSet) *string {
+	return fs.String("login", string(backupjob.LoginAuto), backupjob.LoginUsage)
+}
+
+func setLogin(s string) {
+	mode, err := backupjob.ParseLoginMode(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	job.LoginMode = mode
+}
+
+// addScheduleFlags registers the schedule flags on fs, except the cron
+// expression itself, which setup prompts for.
+func addScheduleFlags(fs *flag.FlagSet) *backupjob.Schedule {
+	s := &backupjob.Schedule{}
+	fs.StringVar(&s.TimeZone, "time-zone", "", "IANA time zone the schedule is in, e.g. Europe/Berlin (default the cluster's, usually UTC)")
+	fs.StringVar(&s.ConcurrencyPolicy, "concurrency-policy", backupjob.DefaultConcurrencyPolicy, "what to do when a run is due while the last is still going: Allow, Forbid or Replace")
+	fs.Int64Var(&s.StartingDeadlineSeconds, "starting-deadline", 0, "seconds after its time a missed run may still start (0 means no deadline)")
+	return s
+}
+
+// loadJobConfig reads the -config file, which names the job and replaces
+// the schedule flags.
+func loadJobConfig(fs *flag.FlagSet, file string, schedule *backupjob.Schedule) *backupjob.ConfigFile {
+	cfg, err := backupjob.LoadConfigFile(file)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	fromConfig, s, err := backupjob.FromConfigFile(cfg)
+	if err != nil {
+		log.Fatalf("Invalid config: %s: %v", file, err)
+	}
+	if backupjob.IsFlagSet(fs, "job") && job.Name != fromConfig.Name {
+		log.Fatalf("Invalid config: %s: name: %q does not match -job %q", file, fromConfig.Name, job.Name)
+	}
+	job.Name, *schedule = fromConfig.Name, s
+	return cfg
+}
+
+// connect checks the job name and connects to its cluster.
+func connect() {
+	if err := job.Connect(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseNoArgs parses a command's flags, which must be all it is given.
+func parseNoArgs(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Fprintf(fs.Output(), "setup %s: unexpected argument %q\n", fs.Name(), fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func loginMain(fs *flag.FlagSet, args []string) {
+	loginFlag := addLoginFlag(fs)
+	force := fs.Bool("force", false, "log in again even if there is a saved token")
+	parseNoArgs(fs, args)
+	setLogin(*loginFlag)
+	connect()
+	if err := job.Login(context.Background(), *force); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Logged in job %s\n", job.Name)
+}
+
+func logoutMain(fs *flag.FlagSet, args []string) {
+	parseNoArgs(fs, args)
+	connect()
+	if err := job.Logout(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Logged out job %s\n", job.Name)
+}
+
+// addApplyFlags registers the flags giving what apply puts on the cluster
+// on fs. The returned function reads them once fs is parsed.
+func addApplyFlags(fs *flag.FlagSet) func() backupjob.ApplySettings {
+	configFile := fs.String("config", "", "backup config file (YAML or JSON) giving the job, schedule and folder")
+	cron := fs.String("schedule", "", "cron expression, macro such as @daily, or number of minutes (required without -config)")
+	schedule := addScheduleFlags(fs)
+	dir := fs.String("source", "", "directory to back up, as setup asks for it (required without -config)")
+	return func() backupjob.ApplySettings {
+		s := backupjob.ApplySettings{Dir: *dir}
+		if *configFile != "" {
+			s.Config = loadJobConfig(fs, *configFile, schedule)
+			s.Dir = s.Config.Source.Path
+		} else {
+			if *cron == "" || *dir == "" {
+				log.Fatalf("%s needs -schedule and -source, or -config", fs.Name())
+			}
+			var err error
+			if schedule.Cron, err = backupjob.ParseScheduleInput(*cron); err != nil {
+				log.Fatal(err)
+			}
+		}
+		s.Schedule = *schedule
+		return s
+	}
+}
+
+func applyMain(fs *flag.FlagSet, args []string) {
+	settings := addApplyFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "print the planned changes without making them")
+	parseNoArgs(fs, args)
+	s := settings()
+	connect()
+	if err := job.Apply(context.Background(), os.Stdout, s, *dryRun); err != nil {
+		log.Fatalf("Failed to apply configuration: %v", err)
+	}
+}
+
+func exportMain(fs *flag.FlagSet, args []string) {
+	settings := addApplyFlags(fs)
+	formatFlag := fs.String("format", string(formatHelm), "what to write: helm for a chart or kustomize for a base")
+	out := fs.String("out", "", "directory to write to (default <job>-chart or <job>-kustomize)")
+	withSecrets := fs.Bool("with-secrets", false, "include the OAuth client and keys, unencrypted, for the chart or base to create the Secrets (the login token stays with setup login)")
+	parseNoArgs(fs, args)
+	format, err := parseExportFormat(*formatFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := settings()
+	// The namespace goes into the kustomize base; connecting only reads
+	// the kubeconfig for it. A chart takes its release's namespace.
+	if format == formatKustomize && job.Namespace == "" {
+		connect()
+	} else if err := job.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	dir := *out
+	if dir == "" {
+		dir = job.Name + "-chart"
+		if format == formatKustomize {
+			dir = job.Name + "-kustomize"
+		}
+	}
+	if err := exportJob(dir, format, s, *withSecrets); err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+	fmt.Printf("Wrote %s %s to %s\n", job.Name, format, dir)
+	if *withSecrets {
+		fmt.Println("It holds credentials in the clear; encrypt them, e.g. with SOPS, before committing it")
+	}
+	if !job.HasServiceAccountKey() {
+		fmt.Println("The login token is not included, since the backup refreshes it in the cluster; create it with setup login after deploying")
+	}
+}
+
+func statusMain(fs *flag.FlagSet, args []string) {
+	parseNoArgs(fs, args)
+	connect()
+	if err := job.PrintStatus(context.Background(), os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// addWaitFlag registers -timeout, which bounds waiting for a run, on fs.
+func addWaitFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("timeout", time.Hour, "how long to wait for the run to finish")
+}
+
+func runMain(fs *flag.FlagSet, args []string) {
+	wait := fs.Bool("wait", false, "wait for the backup to finish and print its log")
+	timeout := addWaitFlag(fs)
+	parseNoArgs(fs, args)
+	connect()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := job.Run(ctx, os.Stdout, nil, nil, *wait); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func restoreMain(fs *flag.FlagSet, args []string) {
+	pattern := fs.String("path", "", "only restore this path or glob within the backup")
+	conflict := fs.String("conflict", "skip", "what to do with existing files: skip, overwrite or rename")
+	dryRun := fs.Bool("dry-run", false, "list what would be restored without writing anything")
+	snapshot := fs.String("snapshot", "", "restore the state recorded by this snapshot ID, or \"latest\"")
+	target := fs.String("target", "backup", "directory in the backup's pod to restore into, relative to /app, where backup is the backed-up folder")
+	timeout := addWaitFlag(fs)
+	parseNoArgs(fs, args)
+
+	restoreArgs := []string{"-conflict", *conflict}
+	if *pattern != "" {
+		restoreArgs = append(restoreArgs, "-path", *pattern)
+	}
+	if *dryRun {
+		restoreArgs = append(restoreArgs, "-dry-run")
+	}
+	if *snapshot != "" {
+		restoreArgs = append(restoreArgs, "-snapshot", *snapshot)
+	}
+	restoreArgs = append(restoreArgs, *target)
+
+	connect()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := job.Run(ctx, os.Stdout, []string{"restore"}, restoreArgs, true); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func snapshotsMain(fs *flag.FlagSet, args []string) {
+	timeout := addWaitFlag(fs)
+	parseNoArgs(fs, args)
+	connect()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := job.Run(ctx, os.Stdout, []string{"snapshots", "list"}, nil, true); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func stopMain(fs *flag.FlagSet, args []string) {
+	parseNoArgs(fs, args)
+	connect()
+	if err := job.Stop(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Stopped backup job %s\n", job.Name)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"backupjob"
+	"sigs.k8s.io/yaml"
+)
+
+// chartFS holds the Helm chart's templates for the objects apply does not
+// render from manifests: the config ConfigMap and the Secrets. The rest of
+// the chart is backupjob's manifest templates.
+//
+//go:embed all:manifests/helm
+var chartFS embed.FS
+
+// exportFormat is the kind of package export writes.
+type exportFormat string
+
+const (
+	formatHelm      exportFormat = "helm"
+	formatKustomize exportFormat = "kustomize"
+)
+
+func parseExportFormat(s string) (exportFormat, error) {
+	switch exportFormat(s) {
+	case formatHelm, formatKustomize:
+		return exportFormat(s), nil
+	}
+	return "", fmt.Errorf("unknown export format %q (want helm or kustomize)", s)
+}
+
+// secretFile is a local file that one of the job's Secrets holds.
+type secretFile struct {
+	Secret, Key, File string
+}
+
+// jobSecretFiles lists the job's Secrets that have a local file to fill
+// them from, as login would. The token is left out: the backup writes
+// refreshed tokens back to its Secret, and a chart or base that owned it
+// would put the stale one back on every sync.
+func jobSecretFiles() []secretFile {
+	n := job.Names()
+	all := []secretFile{
+		{n.ServiceAccountSecret, "key.json", job.ServiceAccountKey()},
+		{n.EncryptionSecret, "encryption.key", job.EncryptionKey()},
+	}
+	if !job.HasServiceAccountKey() {
+		all = append(all, secretFile{n.CredentialsSecret, "credentials.json", backupjob.CredentialsFile})
+	}
+	var files []secretFile
+	for _, f := range all {
+		if _, err := os.Stat(f.File); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// exportJob writes the job as a Helm chart or kustomize base into dir, for
+// deploying it declaratively instead of with apply. Secrets are only
+// included if withSecrets is set, since they hold credentials in the clear.
+func exportJob(dir string, format exportFormat, s backupjob.ApplySettings, withSecrets bool) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	var secrets []secretFile
+	if withSecrets {
+		secrets = jobSecretFiles()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if format == formatHelm {
+		return exportChart(dir, s, secrets)
+	}
+	return exportKustomize(dir, s, secrets)
+}
+
+// chartValues are the Helm chart's values.yaml: the manifest templates'
+// values and those of the chart's own templates.
+type chartValues struct {
+	backupjob.ManifestValues
+	// Config is the backup config file the container reads, if any.
+	Config  string       `json:"config,omitempty"`
+	Secrets chartSecrets `json:"secrets"`
+}
+
+// chartSecrets are base64 file contents for the job's Secrets; each one
+// left empty is not created by the chart.
+type chartSecrets struct {
+	Credentials       string `json:"credentials"`
+	ServiceAccountKey string `json:"serviceAccountKey"`
+	EncryptionKey     string `json:"encryptionKey"`
+}
+
+type chartMetadata struct {
+	APIVersion  string `json:"apiVersion"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Version     string `json:"version"`
+	AppVersion  string `json:"appVersion"`
+}
+
+func exportChart(dir string, s backupjob.ApplySettings, secrets []secretFile) error {
+	values := chartValues{ManifestValues: backupjob.ManifestValues{
+		Names:    job.Names(),
+		Schedule: s.Schedule,
+		HostPath: backupjob.HostPath(s.Dir),
+		Image:    backupjob.BackupImage,
+	}}
+	if s.Config != nil {
+		b, err := yaml.Marshal(s.Config)
+		if err != nil {
+			return err
+		}
+		values.Config = string(b)
+	}
+	for _, f := range secrets {
+		b, err := os.ReadFile(f.File)
+		if err != nil {
+			return err
+		}
+		v := base64.StdEncoding.EncodeToString(b)
+		switch f.Key {
+		case "credentials.json":
+			values.Secrets.Credentials = v
+		case "key.json":
+			values.Secrets.ServiceAccountKey = v
+		case "encryption.key":
+			values.Secrets.EncryptionKey = v
+		}
+	}
+
+	chart := chartMetadata{
+		APIVersion:  "v2",
+		Name:        job.Name,
+		Description: "Scheduled backup of a node directory to Google Drive",
+		Type:        "application",
+		Version:     "0.1.0",
+		AppVersion:  "latest",
+	}
+	if err := writeYAML(filepath.Join(dir, "Chart.yaml"), chart, 0644); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if len(secrets) > 0 {
+		mode = 0600
+	}
+	if err := writeYAML(filepath.Join(dir, "values.yaml"), values, mode); err != nil {
+		return err
+	}
+
+	templates := filepath.Join(dir, "templates")
+	if err := copyFS(templates, backupjob.ManifestTemplates(), "."); err != nil {
+		return err
+	}
+	return copyFS(templates, chartFS, "manifests/helm/templates")
+}
+
+// copyFS copies the files under root in fsys into dir.
+func copyFS(dir string, fsys fs.FS, root string) error {
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		out := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(out, b, 0644)
+	})
+}
+
+// kustomization is a kustomize base's kustomization.yaml.
+type kustomization struct {
+	APIVersion         string               `json:"apiVersion"`
+	Kind               string               `json:"kind"`
+	Namespace          string               `json:"namespace"`
+	Resources          []string             `json:"resources"`
+	ConfigMapGenerator []kustomizeGenerator `json:"configMapGenerator,omitempty"`
+	SecretGenerator    []kustomizeGenerator `json:"secretGenerator,omitempty"`
+	GeneratorOptions   *kustomizeGenOptions `json:"generatorOptions,omitempty"`
+}
+
+type kustomizeGenerator struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+type kustomizeGenOptions struct {
+	// DisableNameSuffixHash keeps the names the CronJob and Role refer to.
+	DisableNameSuffixHash bool `json:"disableNameSuffixHash"`
+}
+
+func exportKustomize(dir string, s backupjob.ApplySettings, secrets []secretFile) error {
+	manifests, err := job.Manifests(s.Schedule, backupjob.HostPath(s.Dir))
+	if err != nil {
+		return err
+	}
+	k := kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Namespace:  job.Namespace,
+	}
+	for i, name := range []string{"rbac.yaml", "pvc.yaml", "cronjob.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(manifests[i]), 0644); err != nil {
+			return err
+		}
+		k.Resources = append(k.Resources, name)
+	}
+
+	if s.Config != nil {
+		b, err := yaml.Marshal(s.Config)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, backupjob.ConfigFileKey), b, 0644); err != nil {
+			return err
+		}
+		k.ConfigMapGenerator = append(k.ConfigMapGenerator, kustomizeGenerator{Name: job.Names().BackupConfig, Files: []string{backupjob.ConfigFileKey}})
+	}
+	if len(secrets) > 0 {
+		if err := os.MkdirAll(filepath.Join(dir, "secrets"), 0700); err != nil {
+			return err
+		}
+	}
+	for _, f := range secrets {
+		b, err := os.ReadFile(f.File)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "secrets", f.Key), b, 0600); err != nil {
+			return err
+		}
+		k.SecretGenerator = append(k.SecretGenerator, kustomizeGenerator{Name: f.Secret, Files: []string{f.Key + "=" + path.Join("secrets", f.Key)}})
+	}
+	if k.ConfigMapGenerator != nil || k.SecretGenerator != nil {
+		k.GeneratorOptions = &kustomizeGenOptions{DisableNameSuffixHash: true}
+	}
+	return writeYAML(filepath.Join(dir, "kustomization.yaml"), k, 0644)
+}
+
+func writeYAML(file string, v interface{}, mode os.FileMode) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, mode)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"backupjob"
+	"sigs.k8s.io/yaml"
+)
+
+func testSettings() backupjob.ApplySettings {
+	return backupjob.ApplySettings{
+		Schedule: backupjob.Schedule{Cron: "30 2 * * *", ConcurrencyPolicy: backupjob.DefaultConcurrencyPolicy},
+		Dir:      "photos",
+	}
+}
+
+func useTestJob(t *testing.T) {
+	t.Helper()
+	saved := job.Config
+	job.Config = backupjob.Config{Name: "photos", Namespace: "backups"}
+	t.Cleanup(func() { job.Config = saved })
+}
+
+// renderChart renders the chart in dir as Helm would install it into
+// namespace, with the Sprig functions its templates use.
+func renderChart(t *testing.T, dir, namespace string, values map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	var objects []map[string]interface{}
+	for name, out := range renderChartFiles(t, dir, namespace, values) {
+		for _, doc := range strings.Split(out, "\n---") {
+			var obj map[string]interface{}
+			if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+				t.Fatalf("%s: %v\n%s", name, err, doc)
+			}
+			if obj != nil {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	return objects
+}
+
+// renderChartFiles renders each of the chart's templates, returning the
+// text by file name.
+func renderChartFiles(t *testing.T, dir, namespace string, values map[string]interface{}) map[string]string {
+	t.Helper()
+	var tmpl *template.Template
+	tmpl = template.New("chart").Funcs(template.FuncMap{
+		"toJson": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"dict": func(kv ...interface{}) map[string]interface{} {
+			d := map[string]interface{}{}
+			for i := 0; i+1 < len(kv); i += 2 {
+				d[kv[i].(string)] = kv[i+1]
+			}
+			return d
+		},
+		"include": func(name string, data interface{}) (string, error) {
+			var b strings.Builder
+			err := tmpl.ExecuteTemplate(&b, name, data)
+			return b.String(), err
+		},
+	})
+	files, err := filepath.Glob(filepath.Join(dir, "templates", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tmpl.New(filepath.Base(f)).Parse(string(b)); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+	}
+
+	data := map[string]interface{}{"Values": values, "Release": map[string]interface{}{"Namespace": namespace}}
+	rendered := map[string]string{}
+	for _, f := range files {
+		name := filepath.Base(f)
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		var out strings.Builder
+		if err := tmpl.ExecuteTemplate(&out, name, data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		rendered[name] = out.String()
+	}
+	return rendered
+}
+
+func readValues(t *testing.T, dir string) map[string]interface{} {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, "values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// field returns the value at the dotted path in obj, indexing lists by
+// their first element.
+func field(obj map[string]interface{}, path string) interface{} {
+	var v interface{} = obj
+	for _, k := range strings.Split(path, ".") {
+		if l, ok := v.([]interface{}); ok && len(l) > 0 {
+			v = l[0]
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func TestExportChart(t *testing.T) {
+	useTestJob(t)
+	dir := t.TempDir()
+	if err := exportJob(dir, formatHelm, testSettings(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Chart.yaml")); err != nil {
+		t.Error(err)
+	}
+
+	// Installed into another namespace than it was exported from, every
+	// object that names the namespace follows the release.
+	objects := renderChart(t, dir, "media", readValues(t, dir))
+	byKind := map[string]map[string]interface{}{}
+	for _, o := range objects {
+		byKind[o["kind"].(string)] = o
+	}
+	tests := []struct {
+		kind, path string
+		want       interface{}
+	}{
+		{"PersistentVolume", "metadata.name", "media-photos"},
+		{"PersistentVolume", "spec.hostPath.path", backupjob.HostPath("photos")},
+		{"PersistentVolumeClaim", "spec.volumeName", "media-photos"},
+		{"RoleBinding", "subjects.namespace", "media"},
+		{"ServiceAccount", "metadata.name", "photos"},
+		{"Role", "rules.resourceNames", []interface{}{"photos-token"}},
+		{"CronJob", "spec.schedule", "30 2 * * *"},
+		{"CronJob", "spec.timeZone", nil},
+		{"CronJob", "spec.startingDeadlineSeconds", nil},
+		{"CronJob", "spec.jobTemplate.spec.template.spec.containers.image", backupjob.BackupImage},
+	}
+	for _, tt := range tests {
+		o, ok := byKind[tt.kind]
+		if !ok {
+			t.Errorf("chart has no %s", tt.kind)
+			continue
+		}
+		got, _ := json.Marshal(field(o, tt.path))
+		want, _ := json.Marshal(tt.want)
+		if string(got) != string(want) {
+			t.Errorf("%s %s = %s, want %s", tt.kind, tt.path, got, want)
+		}
+	}
+	if len(objects) != 6 {
+		t.Errorf("chart has %d objects, want 6", len(objects))
+	}
+}
+
+func TestExportChartValues(t *testing.T) {
+	useTestJob(t)
+	dir := t.TempDir()
+	s := testSettings()
+	s.Schedule.TimeZone = "Europe/Berlin"
+	s.Schedule.StartingDeadlineSeconds = 2592000
+	if err := exportJob(dir, formatHelm, s, false); err != nil {
+		t.Fatal(err)
+	}
+	values := readValues(t, dir)
+	values["config"] = "name: photos\n"
+	values["secrets"] = map[string]interface{}{"encryptionKey": "a2V5", "token": "dG9rZW4="}
+
+	var cronJob map[string]interface{}
+	var config interface{}
+	secrets := map[string]bool{}
+	for _, o := range renderChart(t, dir, "backups", values) {
+		switch o["kind"] {
+		case "CronJob":
+			cronJob = o
+		case "Secret":
+			secrets[field(o, "metadata.name").(string)] = true
+		case "ConfigMap":
+			config = o["data"].(map[string]interface{})[backupjob.ConfigFileKey]
+		}
+	}
+	if config != "name: photos\n" {
+		t.Errorf("config = %q", config)
+	}
+	if got := field(cronJob, "spec.timeZone"); got != "Europe/Berlin" {
+		t.Errorf("timeZone = %v", got)
+	}
+	if got := field(cronJob, "spec.startingDeadlineSeconds"); got != 2592000.0 {
+		t.Errorf("startingDeadlineSeconds = %v", got)
+	}
+	// Helm reads the values as float64; the chart must still write the
+	// deadline as an integer, which Kubernetes needs, not as 2.592e+06.
+	if cron := renderChartFiles(t, dir, "backups", values)["cron.yml"]; !strings.Contains(cron, "\n  startingDeadlineSeconds: 2592000\n") {
+		t.Errorf("chart writes the deadline as:\n%s", cron)
+	}
+	// The token Secret is refreshed in the cluster, so the chart never
+	// creates it, even from a value someone added.
+	if !secrets["photos-encryption-key"] || secrets["photos-token"] || len(secrets) != 1 {
+		t.Errorf("chart creates Secrets %v, want only photos-encryption-key", secrets)
+	}
+}
+
+func TestExportKustomize(t *testing.T) {
+	useTestJob(t)
+	dir := t.TempDir()
+	if err := exportJob(dir, formatKustomize, testSettings(), false); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k kustomization
+	if err := yaml.UnmarshalStrict(b, &k); err != nil {
+		t.Fatal(err)
+	}
+	if k.Namespace != "backups" || strings.Join(k.Resources, ",") != "rbac.yaml,pvc.yaml,cronjob.yaml" || k.SecretGenerator != nil {
+		t.Errorf("kustomization = %+v", k)
+	}
+	manifests, err := job.Manifests(testSettings().Schedule, backupjob.HostPath("photos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range k.Resources {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != manifests[i] {
+			t.Errorf("%s differs from what apply renders", name)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+{{/* A Secret holding one file, given its name, key and base64 contents. */}}
+{{- define "drive-backup.secret" }}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ .name | toJson }}
+type: Opaque
+data:
+  {{ .key | toJson }}: {{ .value | toJson }}
+{{- end }}
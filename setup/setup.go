@@ -3,267 +3,113 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
 	"runtime"
-	"strconv"
 	"strings"
 
-	"crypto/rand"
-	"encoding/base64"
-
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/drive/v3"
+	"backupjob"
 )
 
-func main() {
-	b, err := os.ReadFile("../config/credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
-	}
+// job is the backup job being configured.
+var job = &backupjob.Job{Config: backupjob.Config{Name: backupjob.DefaultName}}
 
-	config, err := google.ConfigFromJSON(b, drive.DriveScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		commandMain(os.Args[1], os.Args[2:])
+		return
 	}
+	interactiveMain(os.Args[1:])
+}
 
-	_ = getClient(config)
-
-	// Prompt for cron job frequency
-	fmt.Print("Enter the frequency of the cron job in minutes: ")
+// interactiveMain logs in and asks for the settings the flags and config
+// file leave open, then applies the job, like the commands do one by one.
+func interactiveMain(args []string) {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintln(fs.Output(), "\nFlags without a command:")
+		fs.PrintDefaults()
+	}
+	addJobFlags(fs)
+	loginFlag := addLoginFlag(fs)
+	schedule := addScheduleFlags(fs)
+	configFile := fs.String("config", "", "backup config file (YAML or JSON) giving the job, schedule and folder instead of the prompts and flags")
+	fs.Parse(args)
+	setLogin(*loginFlag)
+	var cfg *backupjob.ConfigFile
+	if *configFile != "" {
+		cfg = loadJobConfig(fs, *configFile, schedule)
+	}
+	connect()
+	fmt.Printf("Configuring backup job %s in namespace %s\n", job.Name, job.Namespace)
+
+	ctx := context.Background()
+	if job.HasServiceAccountKey() {
+		fmt.Println("Using service account key; skipping browser login")
+	}
+	if err := job.Login(ctx, false); err != nil {
+		log.Fatal(err)
+	}
+
+	// Prompt for the schedule until it is valid
 	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-	minutes, err := strconv.Atoi(input)
-	if err != nil {
-		log.Fatalf("Invalid input: %v", err)
+	for cfg == nil {
+		fmt.Print("Enter the backup schedule (cron expression like \"30 2 * * *\", a macro like @daily, or minutes): ")
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			log.Fatalf("Invalid input: %v", err)
+		}
+		schedule.Cron, err = backupjob.ParseScheduleInput(input)
+		if err == nil {
+			err = schedule.Validate()
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("Next runs:\n%s", schedule.PreviewRuns(5))
+		break
 	}
 
-	// Generate CronJob YAML configuration
-	cronJobYAML := generateCronJobYAML(minutes)
-
-	// Prompt for cron job frequency
-	if runtime.GOOS == "linux" {
-		fmt.Print("Enter backup folder dir relative to minikube mount (/host)")
-	} else if runtime.GOOS == "windows" {
-		fmt.Print("Enter backup folder dir relative c drive (/c/Users/...)")
+	var dir string
+	if cfg != nil {
+		dir = cfg.Source.Path
 	} else {
-		fmt.Print("Enter backup folder dir relative to kubernetes root")
-	}
+		// Prompt for the folder to back up
+		if runtime.GOOS == "linux" {
+			fmt.Print("Enter backup folder dir relative to minikube mount (/host)")
+		} else if runtime.GOOS == "windows" {
+			fmt.Print("Enter backup folder dir relative c drive (/c/Users/...)")
+		} else {
+			fmt.Print("Enter backup folder dir relative to kubernetes root")
+		}
 
-	reader = bufio.NewReader(os.Stdin)
-	input, _ = reader.ReadString('\n')
-	dir := strings.TrimSpace(input)
-	if err != nil {
-		log.Fatalf("Invalid input: %v", err)
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			log.Fatalf("Invalid input: %v", err)
+		}
+		dir = strings.TrimSpace(input)
 	}
 
-	// Generate CronJob YAML configuration
-	pvcYaml := generatePvcYAML(dir)
-
-	// Read deployment YAML
-	_deploy, err := os.ReadFile("../config/deployment.yml")
-	if err != nil {
-		log.Fatalf("Unable to read deployment YAML: %v", err)
+	s := backupjob.ApplySettings{Schedule: *schedule, Dir: dir, Config: cfg}
+	if err := job.Apply(ctx, os.Stdout, s, false); err != nil {
+		log.Fatalf("Failed to apply configuration: %v", err)
+	}
+	if job.HasServiceAccountKey() {
+		fmt.Println("Setup complete!")
+		return
 	}
-	deploymentYaml := string(_deploy)
-
-	// Apply CronJob YAML to Kubernetes deployment
-	applyYAML(deploymentYaml, cronJobYAML, pvcYaml)
 	// Check if user wants to logout
 	fmt.Print("Do you want to logout? (yes/no): ")
 	text, _ := reader.ReadString('\n')
 	if strings.TrimSpace(text) == "yes" {
-		// Remove existing token
-		fmt.Print(text)
-		os.Remove("../config/token.json")
-
-		reader := bufio.NewReader(os.Stdin)
-		_, _ = reader.ReadString('\n')
-		// Re-run login to get new token
-		getClient(config)
-		// Update Kubernetes secret
-		err = updateKubernetesSecret("../config/token.json")
-		if err != nil {
-			log.Fatalf("Failed to update Kubernetes secret: %v", err)
+		// Log in again, e.g. with another account
+		if err := job.Login(ctx, true); err != nil {
+			log.Fatal(err)
 		}
 	}
 	fmt.Println("Setup complete!")
 }
-
-func getClient(config *oauth2.Config) *http.Client {
-	tokFile := "../config/token.json"
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
-	}
-	return config.Client(context.Background(), tok)
-}
-
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	state := randToken()
-	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
-	codeCh := make(chan string)
-
-	go func() {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			if r.FormValue("state") != state {
-				http.Error(w, "State invalid", http.StatusBadRequest)
-				codeCh <- "State invalid"
-				return
-			}
-			// send test response
-			w.Write([]byte("Authorization successful! You can close this tab now."))
-
-			codeCh <- r.FormValue("code")
-		})
-
-		log.Fatal(http.ListenAndServe(":8080", nil))
-	}()
-
-	fmt.Println("Opening browser to visit the following URL:")
-	if runtime.GOOS == "linux" {
-		fmt.Print("In linux login")
-		cmd := exec.Command("xdg-open", authURL)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Unable to open browser: %v, output: %s", err, output)
-			fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-		}
-	} else if runtime.GOOS == "windows" {
-		// fmt.Println("MY AUTH URL IS : ", authURL)
-		// cmd := exec.Command("cmd", "/c", "start", "", authURL)
-		// cmd := exec.Command("cmd", "/c", "start", authURL)
-		// err := cmd.Start()
-		// if err != nil {
-		// fmt.Printf("Unable to open browser: %v", err)
-		fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-		// }
-	}
-	// fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-
-	code := <-codeCh
-	tok, err := config.Exchange(context.TODO(), code)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
-	}
-	return tok
-}
-
-func randToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
-}
-
-func saveToken(path string, token *oauth2.Token) {
-	//fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
-	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
-}
-
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
-}
-
-func generateCronJobYAML(minutes int) string {
-	cronTemplate, err := os.ReadFile("../config/cron.yml")
-	if err != nil {
-		log.Fatalf("Unable to read cron job template: %v", err)
-	}
-	return fmt.Sprintf(string(cronTemplate), minutes)
-
-}
-
-func generatePvcYAML(dir string) string {
-	pvcTemplate, err := os.ReadFile("../config/pvc.yml")
-	if err != nil {
-		log.Fatalf("Unable to read cron job template: %v", err)
-	}
-	if runtime.GOOS == "linux" {
-		dir = "/host/" + dir
-	} else if runtime.GOOS == "windows" {
-		dir = "/run/desktop/mnt/host/" + dir
-	}
-	return fmt.Sprintf(string(pvcTemplate), dir)
-
-}
-
-func applyYAML(deployYaml, cronYaml, pvcYaml string) {
-	// delete deployment if it already exists
-	cmd := exec.Command("kubectl", "delete", "deployment", "drive-backup-deployment")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting deployent: %v, output: %s", err, output)
-	}
-	// delete cronjob if it already exists
-	cmd = exec.Command("kubectl", "delete", "cronjob", "drive-backup-cronjob")
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting cronjob: %v, output: %s", err, output)
-	}
-	// delete pv and pvc if they already exist
-	cmd = exec.Command("kubectl", "delete", "pvc", "backup-pvc")
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting pvc: %v, output: %s", err, output)
-	}
-	cmd = exec.Command("kubectl", "delete", "pv", "backup-pv")
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting pv: %v, output: %s", err, output)
-	}
-
-	// create deployment
-	cmd = exec.Command("kubectl", "apply", "-f", "-")
-	cmd.Stdin = strings.NewReader(deployYaml)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error applying deploy YAML: %v, output: %s", err, output)
-	}
-	// create pvc
-	cmd = exec.Command("kubectl", "apply", "-f", "-")
-	cmd.Stdin = strings.NewReader(pvcYaml)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error applying pvc YAML: %v, output: %s", err, output)
-	}
-	// create cronjob
-	cmd = exec.Command("kubectl", "apply", "-f", "-")
-	cmd.Stdin = strings.NewReader(cronYaml)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error applying cron YAML: %v, output: %s", err, output)
-	}
-}
-
-func updateKubernetesSecret(tokenFile string) error {
-	cmdDelete := exec.Command("kubectl", "delete", "secret", "token")
-	if err := cmdDelete.Run(); err != nil {
-		fmt.Printf("error deleting existing secret: %v", err)
-	}
-
-	fileFlag := fmt.Sprintf("--from-file=%s", tokenFile)
-	cmdCreate := exec.Command("kubectl", "create", "secret", "generic", "token", fileFlag)
-	if err := cmdCreate.Run(); err != nil {
-		return fmt.Errorf("error creating new secret: %v", err)
-	}
-	return nil
-}
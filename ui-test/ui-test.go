@@ -3,51 +3,98 @@ package main
 import (
 	// "bufio"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
-	"runtime"
 	"strconv"
 	"strings"
 
-	"crypto/rand"
-	"encoding/base64"
-
+	"backupjob"
 	"github.com/rivo/tview"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/drive/v3"
 )
 
 var (
-	app      *tview.Application
-	cronFreq int
-	filePath string
-	logout   bool
-	config   *oauth2.Config
-	url      string
-	modal    *tview.Modal
+	app *tview.Application
+	// scheduleInput is the schedule as typed; schedule holds the rest of
+	// the schedule settings.
+	scheduleInput string
+	schedule      = backupjob.Schedule{ConcurrencyPolicy: backupjob.DefaultConcurrencyPolicy}
+	filePath      string
+	logout        bool
+	modal         *tview.Modal
+	// job is the backup job being configured.
+	job = &backupjob.Job{Config: backupjob.Config{Name: backupjob.DefaultName}}
+	// cfg is the -config file the form was filled in from, if any.
+	cfg *backupjob.ConfigFile
 )
 
 func main() {
-
+	loginFlag := flag.String("login", string(backupjob.LoginAuto), backupjob.LoginUsage)
+	flag.StringVar(&job.Name, "job", backupjob.DefaultName, "name of the backup job; give each job on a cluster its own")
+	flag.StringVar(&job.Namespace, "namespace", "", "namespace for the job (default the kubeconfig context's namespace)")
+	flag.StringVar(&job.Context, "context", "", "kubeconfig context to use (default the current context)")
+	configFile := flag.String("config", "", "backup config file (YAML or JSON) to fill the form in from")
+	flag.Parse()
+	mode, err := backupjob.ParseLoginMode(*loginFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	job.LoginMode = mode
+	if *configFile != "" {
+		if cfg, err = backupjob.LoadConfigFile(*configFile); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		fromConfig, s, err := backupjob.FromConfigFile(cfg)
+		if err != nil {
+			log.Fatalf("Invalid config: %s: %v", *configFile, err)
+		}
+		if backupjob.IsFlagSet(flag.CommandLine, "job") && job.Name != fromConfig.Name {
+			log.Fatalf("Invalid config: %s: name: %q does not match -job %q", *configFile, fromConfig.Name, job.Name)
+		}
+		job.Name, schedule = fromConfig.Name, s
+		scheduleInput, filePath = s.Cron, cfg.Source.Path
+	}
+	if err := job.Connect(); err != nil {
+		log.Fatal(err)
+	}
 	// _ = getClient(config)
 	app = tview.NewApplication()
 
 	form := tview.NewForm()
 
-	form.AddInputField("Cronjob Frequency (minutes)", "", 0, nil, func(text string) {
-		cronFreq, _ = strconv.Atoi(text)
+	policies := []string{"Forbid", "Allow", "Replace"}
+	policy := 0
+	for i, p := range policies {
+		if p == schedule.ConcurrencyPolicy {
+			policy = i
+		}
+	}
+	deadline := ""
+	if schedule.StartingDeadlineSeconds > 0 {
+		deadline = strconv.FormatInt(schedule.StartingDeadlineSeconds, 10)
+	}
+
+	form.AddInputField("Schedule (cron, @daily or minutes)", scheduleInput, 0, nil, func(text string) {
+		scheduleInput = text
+		updatePreview(form)
 	}).
-		AddInputField("File Path", "", 0, nil, func(text string) {
+		AddInputField("Time Zone (e.g. Europe/Berlin)", schedule.TimeZone, 0, nil, func(text string) {
+			schedule.TimeZone = strings.TrimSpace(text)
+			updatePreview(form)
+		}).
+		AddDropDown("Concurrency Policy", policies, policy, func(option string, _ int) {
+			schedule.ConcurrencyPolicy = option
+		}).
+		AddInputField("Starting Deadline (seconds)", deadline, 0, tview.InputFieldInteger, func(text string) {
+			schedule.StartingDeadlineSeconds, _ = strconv.ParseInt(text, 10, 64)
+		}).
+		AddTextView(nextRunsLabel, "", 0, 5, false, false).
+		AddInputField("Folder (relative to the host mount)", filePath, 0, nil, func(text string) {
 			filePath = text
 		}).
 		AddButton("Re-Login", func() {
-			// modal := tview.NewModal()
-
 			modal = tview.NewModal().
 				SetText("Please wait for Auth URL").
 				AddButtons([]string{"OK"}).
@@ -56,301 +103,128 @@ func main() {
 				})
 			app.SetRoot(modal, true)
 
-			_ = getAuthURL()
-			fmt.Println("Got auth url")
+			// The login waits for the user, so it runs in its own goroutine
+			// to keep the form responsive, and its messages reach the
+			// modal through the application's event loop.
+			loginModal := modal
+			job.Notify = func(msg string) {
+				app.QueueUpdateDraw(func() {
+					loginModal.SetText(msg)
+				})
+			}
+			go func() {
+				text := "Authenticated Successfully! You can close this box now."
+				if err := job.Login(context.Background(), true); err != nil {
+					text = err.Error()
+				}
+				app.QueueUpdateDraw(func() {
+					loginModal.SetText(text)
+				})
+			}()
+		}).
+		AddButton("Logout", func() {
+			text := "Logged out"
+			if err := job.Logout(context.Background()); err != nil {
+				text = err.Error()
+			}
+			showMessage(form, text)
 		}).
 		AddButton("Apply Configuration", func() {
-
-			 
-			
-			if _, err := os.Stat("../config/token.json"); os.IsNotExist(err) {
-				fmt.Println("Inside not found block")
-				modal = tview.NewModal().
-				SetText("User not logged in. Check your browser for authentication").
-				AddButtons([]string{"OK"}).
-				SetDoneFunc(func(buttonIndex int, buttonLabel string) {
-					app.SetRoot(form, true)
-				})
-				app.SetRoot(modal, true)
+			if _, err := os.Stat(job.TokenFile()); os.IsNotExist(err) && !job.HasServiceAccountKey() {
+				showMessage(form, "User not logged in. Use Re-Login first")
 				return
 			}
-			
-			saveConfiguration()
-			modal = tview.NewModal().
-				SetText("Applied Configuration").
-				AddButtons([]string{"OK"}).
-				SetDoneFunc(func(buttonIndex int, buttonLabel string) {
-					app.SetRoot(form, true)
-				})
-			app.SetRoot(modal, true)
+
+			var plan strings.Builder
+			text := "Applied Configuration"
+			if err := saveConfiguration(&plan); err != nil {
+				text = "Failed to apply configuration: " + err.Error()
+			}
+			showMessage(form, text+"\n\n"+plan.String())
 		}).
-		AddButton("Stop Backup Service", func() {
-			cmd := exec.Command("kubectl", "delete", "cronjob", "drive-backup-cronjob")
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("error deleting cronjob: %v, output: %s", err, output)
-			} else {
-				fmt.Println("Cronjob deleted successfully")
+		AddButton("Status", func() {
+			var status strings.Builder
+			if err := job.PrintStatus(context.Background(), &status); err != nil {
+				status.WriteString(err.Error())
 			}
-			cmd = exec.Command("kubectl", "delete", "pvc", "backup-pvc")
-			output, err = cmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("error deleting pvc: %v, output: %s", err, output)
-			} else {
-				fmt.Println("PVC deleted successfully")
+			showMessage(form, status.String())
+		}).
+		AddButton("Run Now", func() {
+			var out strings.Builder
+			if err := job.Run(context.Background(), &out, nil, nil, false); err != nil {
+				out.WriteString(err.Error())
 			}
-			cmd = exec.Command("kubectl", "delete", "pv", "backup-pv")
-			output, err = cmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("error deleting pv: %v, output: %s", err, output)
-			} else {
-				fmt.Println("PV deleted successfully")
+			showMessage(form, out.String())
+		}).
+		AddButton("Stop Backup Service", func() {
+			text := "Stopped Backup Service"
+			if err := job.Stop(context.Background()); err != nil {
+				text = err.Error()
 			}
-			modal = tview.NewModal().
-				SetText("Stopped Backup Service").
-				AddButtons([]string{"OK"}).
-				SetDoneFunc(func(buttonIndex int, buttonLabel string) {
-					app.SetRoot(form, true)
-				})
-			app.SetRoot(modal, true)
-
+			showMessage(form, text)
 		}).
 		AddButton("Quit", func() {
 			app.Stop()
 		})
 
-	form.SetBorder(true).SetTitle("Drive Settings").SetTitleAlign(tview.AlignCenter)
+	updatePreview(form)
+	form.SetBorder(true).SetTitle(fmt.Sprintf("Drive Settings: %s in %s", job.Name, job.Namespace)).SetTitleAlign(tview.AlignCenter)
 
 	if err := app.SetRoot(form, true).Run(); err != nil {
 		panic(err)
 	}
 }
 
-func getAuthURL() string {
-	// Your authentication URL generation logic here
-	b, err := os.ReadFile("../config/credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
-	}
-
-	config, err := google.ConfigFromJSON(b, drive.DriveScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
-	}
-
-	os.Remove("../config/token.json")
-
-	// Re-run login to get new token
-	getClient(config)
-	// Update Kubernetes secret
-	err = updateKubernetesSecret("../config/token.json")
-	if err != nil {
-		log.Fatalf("Failed to update Kubernetes secret: %v", err)
-	}
-
-	return "https://example.com/auth"
-}
-
-func saveConfiguration() {
-
-	// Generate CronJob YAML configuration
-	cronJobYAML := generateCronJobYAML(cronFreq)
-
-	// Generate PVC YAML configuration
-	pvcYaml := generatePvcYAML(filePath)
-	// Apply CronJob YAML to Kubernetes deployment
-	applyYAML(cronJobYAML, pvcYaml)
-
-	fmt.Println("Setup complete!")
-
-	return
-}
-
-func getClient(config *oauth2.Config) *http.Client {
-	tokFile := "../config/token.json"
-	tok, err := tokenFromFile(tokFile)
-	fmt.Println("In Get CLient trying to get token")
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
-	}
-	return config.Client(context.Background(), tok)
-}
-
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	state := randToken()
-	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
-	fmt.Println("In Get Token from web printing authURL	: ", authURL)
-	codeCh := make(chan string)
-	fmt.Println("In Get Token from web")
-	go func() {
-		fmt.Println("Inside routine")
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			fmt.Println("Inside handle func")
-			if r.FormValue("state") != state {
-				http.Error(w, "State invalid", http.StatusBadRequest)
-				codeCh <- "State invalid"
-				return
-			}
-			// send test response
-			fmt.Println("Sending response")
-			w.Write([]byte("Authorization successful! You can close this tab now."))
-
-			codeCh <- r.FormValue("code")
+// showMessage shows text in a modal that returns to form when closed.
+func showMessage(form *tview.Form, text string) {
+	modal = tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"OK"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			app.SetRoot(form, true)
 		})
-
-		log.Fatal(http.ListenAndServe(":8080", nil))
-	}()
-
-	fmt.Println("Opening browser to visit the following URL:")
-	if runtime.GOOS == "linux" {
-		fmt.Print("In linux login")
-		cmd := exec.Command("xdg-open", authURL)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Unable to open browser: %v, output: %s", err, output)
-			fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-		}
-	} else if runtime.GOOS == "windows" {
-		err := exec.Command("rundll32", "url.dll,FileProtocolHandler", authURL).Start()
-		if err != nil {
-			fmt.Printf("Unable to open browser: %v", err)
-		} else {
-			fmt.Println("Browser opened successfully")
-		}
-		fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-
-	}
-	fmt.Println(" Before modal setting")
-	modal.SetText("Authenticated Successfully! You can close this box now.")
-	fmt.Println(" After modal setting")
-	// fmt.Printf("Please visit the following URL to authorize the application:\n%s\n", authURL)
-
-	code := <-codeCh
-	tok, err := config.Exchange(context.TODO(), code)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
-	}
-	return tok
+	app.SetRoot(modal, true)
 }
 
-func randToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
-}
+// nextRunsLabel labels the form's preview of upcoming runs.
+const nextRunsLabel = "Next Runs"
 
-func saveToken(path string, token *oauth2.Token) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+// updatePreview shows when the schedule in the form will next run, or why
+// it is invalid.
+func updatePreview(form *tview.Form) {
+	view, ok := form.GetFormItemByLabel(nextRunsLabel).(*tview.TextView)
+	if !ok {
+		return
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
-}
-
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
+	if strings.TrimSpace(scheduleInput) == "" {
+		view.SetText("")
+		return
 	}
-	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
-}
-
-func generateCronJobYAML(minutes int) string {
-	cronTemplate, err := os.ReadFile("../config/cron.yml")
-	if err != nil {
-		log.Fatalf("Unable to read cron job template: %v", err)
+	s := schedule
+	var err error
+	if s.Cron, err = backupjob.ParseScheduleInput(scheduleInput); err != nil {
+		view.SetText(err.Error())
+		return
 	}
-	return fmt.Sprintf(string(cronTemplate), minutes)
-
+	view.SetText(s.PreviewRuns(5))
 }
 
-func generatePvcYAML(dir string) string {
-	pvcTemplate, err := os.ReadFile("../config/pvc.yml")
-	if err != nil {
-		log.Fatalf("Unable to read cron job template: %v", err)
-	}
-	// get absolute path of dir
-	cmd := exec.Command("readlink", "-f", dir)
-	output, err := cmd.CombinedOutput()
-	fmt.Println("output: ", string(output))
-	if err != nil {
-		fmt.Printf("error getting absolute path of dir: %v, output: %s", err, output)
-	}
-	dir = strings.TrimSpace(string(output))
-		if runtime.GOOS == "linux" {
-			dir = "/host" + dir
-		} else if runtime.GOOS == "windows" {
-			dir = "/run/desktop/mnt/host" + dir
+// saveConfiguration applies the form to the cluster, writing the planned
+// changes to w.
+func saveConfiguration(w io.Writer) error {
+	var err error
+	if schedule.Cron, err = backupjob.ParseScheduleInput(scheduleInput); err != nil {
+		return err
+	}
+	if cfg != nil {
+		// Keep the stored config in step with what the form applies.
+		cfg.Schedule = backupjob.ConfigSchedule{
+			Cron:                    schedule.Cron,
+			TimeZone:                schedule.TimeZone,
+			ConcurrencyPolicy:       schedule.ConcurrencyPolicy,
+			StartingDeadlineSeconds: schedule.StartingDeadlineSeconds,
 		}
-
-	fmt.Println("dir:",dir)
-
-	return fmt.Sprintf(string(pvcTemplate), dir)
-
-}
-
-func applyYAML(cronYaml, pvcYaml string) {
-
-	// delete cronjob if it already exists
-	cmd := exec.Command("kubectl", "delete", "cronjob", "drive-backup-cronjob")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting cronjob: %v, output: %s", err, output)
-	} else {
-		fmt.Println("Cronjob deleted successfully")
-	}
-	// delete pv and pvc if they already exist
-	cmd = exec.Command("kubectl", "delete", "pvc", "backup-pvc")
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting pvc: %v, output: %s", err, output)
-	} else {
-		fmt.Println("PVC deleted successfully")
-	}
-	cmd = exec.Command("kubectl", "delete", "pv", "backup-pv")
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error deleting pv: %v, output: %s", err, output)
-	} else {
-		fmt.Println("PV deleted successfully")
-	}
-
-	// create pvc
-	cmd = exec.Command("kubectl", "apply", "-f", "-")
-	cmd.Stdin = strings.NewReader(pvcYaml)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error applying pvc YAML: %v, output: %s", err, output)
-	} else {
-		fmt.Println("PVC created successfully")
-
-	}
-	// create cronjob
-	cmd = exec.Command("kubectl", "apply", "-f", "-")
-	cmd.Stdin = strings.NewReader(cronYaml)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("error applying cron YAML: %v, output: %s", err, output)
-	} else {
-		fmt.Println("Cronjob created successfully")
-	}
-}
-
-func updateKubernetesSecret(tokenFile string) error {
-	cmdDelete := exec.Command("kubectl", "delete", "secret", "token")
-	if err := cmdDelete.Run(); err != nil {
-		fmt.Printf("error deleting existing secret: %v", err)
-	}
-
-	fileFlag := fmt.Sprintf("--from-file=%s", tokenFile)
-	cmdCreate := exec.Command("kubectl", "create", "secret", "generic", "token", fileFlag)
-	if err := cmdCreate.Run(); err != nil {
-		return fmt.Errorf("error creating new secret: %v", err)
+		cfg.Source.Path = filePath
 	}
-	return nil
+	return job.Apply(context.Background(), w, backupjob.ApplySettings{Schedule: schedule, Dir: filePath, Config: cfg}, false)
 }